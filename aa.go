@@ -0,0 +1,200 @@
+package tinykaboom
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// AAMode selects how the image is antialiased.
+type AAMode int
+
+const (
+	AANone     AAMode = iota // one ray through the center of every pixel
+	AAAdaptive               // one ray per pixel, then the pixels contrasting with a neighbor are supersampled
+	AADepth                  // one ray per pixel, then the pixels on a depth discontinuity with a neighbor are supersampled
+	AAEdgeMask               // one ray per pixel, then only the pixels where the rays start or stop hitting anything are supersampled
+	AAFull                   // every pixel is supersampled, its depth being the nearest of the samples, AASamples² rays per pixel
+)
+
+// AAModes maps the -aa names to the antialiasing strategies.
+var AAModes = map[string]AAMode{
+	"none":      AANone,
+	"adaptive":  AAAdaptive,
+	"depth":     AADepth,
+	"edge-mask": AAEdgeMask,
+	"full":      AAFull,
+}
+
+// supersample averages a cfg.AASamples x cfg.AASamples grid of rays spread over the pixel (i,j). The rays go
+// through the centers of the cells of the grid, or through points offset by cfg.BlueNoise in them. The depth is
+// the one of the nearest sample.
+//
+// With cfg.CheapAA only the coverage and the palette color are sampled that many times: the lighting is computed
+// once, at the center of the pixel or at the first sample hitting the surface when the center misses it, and
+// reused by all the samples. The silhouette is as smooth as with the full supersampling for about the cost of
+// tracing the samples, but the lighting inside the pixel isn't antialiased.
+func supersample(cfg *RenderConfig, i, j int) (*Vec, float64) {
+	n := cfg.AASamples
+	if n <= 0 {
+		n = 1
+	}
+	j = screen_row(cfg, j)
+	var light float64
+	lit := false
+	if cfg.CheapAA {
+		orig, dir := camera_ray(cfg, float64(i)+0.5, float64(j)+0.5)
+		var hit Vec
+		if sphere_trace(orig, dir, &hit, &cfg.Scene) {
+			light, lit = light_intensity(cfg, &hit), true
+		}
+	}
+
+	sum, depth := NewVec(0, 0, 0), math.Inf(1)
+	for b := 0; b < n; b++ {
+		for a := 0; a < n; a++ {
+			x, y := aa_sample_point(cfg, i, j, a, b, n)
+			if !cfg.CheapAA {
+				c, d := renderSample(cfg, x, y)
+				sum, depth = sum.Add(c), math.Min(depth, d)
+				continue
+			}
+			orig, dir := camera_ray(cfg, x, y)
+			if masked_out(cfg, x, y) {
+				sum = sum.Add(background_color(cfg, x, y, dir))
+				continue
+			}
+			var hit Vec
+			ok, t, _ := sphere_trace_steps(orig, dir, &hit, &cfg.Scene)
+			if c, ft, floor := floor_color(cfg, orig, dir); floor && (!ok || ft < t) {
+				sum, depth = sum.Add(apply_fog(&cfg.Scene, orig, dir, c, ft)), math.Min(depth, ft)
+				continue
+			}
+			if !ok {
+				sum = sum.Add(apply_fog(&cfg.Scene, orig, dir, background_color(cfg, x, y, dir), math.Inf(1)))
+				continue
+			}
+			if !lit {
+				light, lit = light_intensity(cfg, &hit), true
+			}
+			sum, depth = sum.Add(apply_fog(&cfg.Scene, orig, dir, surface_color(cfg, &hit).Mul(light), t)), math.Min(depth, t)
+		}
+	}
+	return sum.Mul(1 / float64(n*n)), depth
+}
+
+// aa_sample_point is the point of the image plane of the sample (a,b) of the n x n grid over the pixel in the
+// column i and the screen row j. The jitter is a function of the pixel, the sample and the seed only, so the
+// image doesn't depend on the order the workers render the pixels in.
+func aa_sample_point(cfg *RenderConfig, i, j, a, b, n int) (x, y float64) {
+	dx, dy := 0.5, 0.5 // offsets of the sample inside its cell of the grid
+	if bn := cfg.BlueNoise; bn != nil {
+		dx, dy = bn.At(i*n+a, j*n+b), bn.At(i*n+a+bn.Width/2, j*n+b+bn.Height/2)
+	} else if cfg.Jitter {
+		h := cfg.JitterSeed ^ uint64(i)*0x9e3779b97f4a7c15 ^ uint64(j)*0xc2b2ae3d27d4eb4f ^ uint64(a+b*n)*0xd6e8feb86659fd93
+		dx, dy = unit_hash(h), unit_hash(h^0xa0761d6478bd642f)
+	}
+	return float64(i) + (float64(a)+dx)/float64(n), float64(j) + (float64(b)+dy)/float64(n)
+}
+
+func contrast(a, b *Vec) float64 {
+	return math.Abs(a.Luminance() - b.Luminance())
+}
+
+// high_contrast_pixels flags the pixels whose luminance differs from one of their 4 neighbors by more than threshold.
+func high_contrast_pixels(f *Frame, threshold float64) []bool {
+	flags := make([]bool, len(f.Color))
+	for j := 0; j < f.Height; j++ {
+		for i := 0; i < f.Width; i++ {
+			c := f.Color[i+j*f.Width]
+			if i+1 < f.Width && contrast(c, f.Color[i+1+j*f.Width]) > threshold {
+				flags[i+j*f.Width], flags[i+1+j*f.Width] = true, true
+			}
+			if j+1 < f.Height && contrast(c, f.Color[i+(j+1)*f.Width]) > threshold {
+				flags[i+j*f.Width], flags[i+(j+1)*f.Width] = true, true
+			}
+		}
+	}
+	return flags
+}
+
+// depth_edge_pixels flags the pixels whose depth differs from one of their 4 neighbors by more than threshold,
+// the silhouette where one of them misses the explosion included.
+func depth_edge_pixels(f *Frame, threshold float64) []bool {
+	edge := func(a, b float64) bool {
+		if math.IsInf(a, 1) || math.IsInf(b, 1) {
+			return math.IsInf(a, 1) != math.IsInf(b, 1)
+		}
+		return math.Abs(a-b) > threshold
+	}
+	flags := make([]bool, len(f.Depth))
+	for j := 0; j < f.Height; j++ {
+		for i := 0; i < f.Width; i++ {
+			d := f.Depth[i+j*f.Width]
+			if i+1 < f.Width && edge(d, f.Depth[i+1+j*f.Width]) {
+				flags[i+j*f.Width], flags[i+1+j*f.Width] = true, true
+			}
+			if j+1 < f.Height && edge(d, f.Depth[i+(j+1)*f.Width]) {
+				flags[i+j*f.Width], flags[i+(j+1)*f.Width] = true, true
+			}
+		}
+	}
+	return flags
+}
+
+// silhouette_pixels flags the pixels where the mask of the rays hitting the explosion or the floor differs
+// from one of their 4 neighbors, the outline of the geometry against the background.
+func silhouette_pixels(f *Frame) []bool {
+	flags := make([]bool, len(f.Depth))
+	hit := func(k int) bool { return !math.IsInf(f.Depth[k], 1) }
+	for j := 0; j < f.Height; j++ {
+		for i := 0; i < f.Width; i++ {
+			h := hit(i + j*f.Width)
+			if i+1 < f.Width && h != hit(i+1+j*f.Width) {
+				flags[i+j*f.Width], flags[i+1+j*f.Width] = true, true
+			}
+			if j+1 < f.Height && h != hit(i+(j+1)*f.Width) {
+				flags[i+j*f.Width], flags[i+(j+1)*f.Width] = true, true
+			}
+		}
+	}
+	return flags
+}
+
+// downsample box filters the frame down by n x n pixel blocks. The depth of the blocks is the nearest one.
+func downsample(f *Frame, n int) *Frame {
+	out := new_frame(f.Width/n, f.Height/n)
+	for j := 0; j < out.Height; j++ {
+		for i := 0; i < out.Width; i++ {
+			sum, depth := NewVec(0, 0, 0), math.Inf(1)
+			for b := 0; b < n; b++ {
+				for a := 0; a < n; a++ {
+					k := i*n + a + (j*n+b)*f.Width
+					sum = sum.Add(f.Color[k])
+					depth = math.Min(depth, f.Depth[k])
+				}
+			}
+			out.Color[i+j*out.Width] = sum.Mul(1 / float64(n*n))
+			out.Depth[i+j*out.Width] = depth
+		}
+	}
+	out.Stats = f.Stats
+	return out
+}
+
+// upscaled is an image enlarged n times by repeating each pixel over n x n pixels, the RenderConfig.CompositeOver
+// of the larger render of the SSAA.
+type upscaled struct {
+	image.Image
+	n int
+}
+
+func (u upscaled) Bounds() image.Rectangle {
+	b := u.Image.Bounds()
+	return image.Rect(b.Min.X, b.Min.Y, b.Min.X+b.Dx()*u.n, b.Min.Y+b.Dy()*u.n)
+}
+
+func (u upscaled) At(x, y int) color.Color {
+	b := u.Image.Bounds()
+	return u.Image.At(b.Min.X+(x-b.Min.X)/u.n, b.Min.Y+(y-b.Min.Y)/u.n)
+}
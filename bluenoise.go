@@ -0,0 +1,116 @@
+package tinykaboom
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+)
+
+// BlueNoise is a tileable threshold texture in [0,1). Unlike white noise its values have no low frequencies, so
+// the dithering and the sample offsets taken from it spread the errors evenly instead of leaving visible clumps.
+type BlueNoise struct {
+	Width, Height int
+	Values        []float64 // row by row
+}
+
+// At returns the value of the texture at (x,y), repeating it over the whole plane.
+func (b *BlueNoise) At(x, y int) float64 {
+	x, y = x%b.Width, y%b.Height
+	if x < 0 {
+		x += b.Width
+	}
+	if y < 0 {
+		y += b.Height
+	}
+	return b.Values[x+y*b.Width]
+}
+
+// NewBlueNoise generates a size x size blue noise texture with the void-and-cluster method of Ulichney: the
+// points of a binary pattern are ranked by repeatedly removing the one in the tightest cluster and adding one
+// in the largest void, measured by a gaussian filter wrapping around the edges. It takes about a quarter of a second for 64.
+func NewBlueNoise(size int) *BlueNoise {
+	const sigma = 1.5
+	n := size * size
+	kernel := make([]float64, n) // filter response at the toroidal offset (dx,dy)
+	for dy := 0; dy < size; dy++ {
+		for dx := 0; dx < size; dx++ {
+			x, y := float64(min(dx, size-dx)), float64(min(dy, size-dy))
+			kernel[dx+dy*size] = math.Exp(-(x*x + y*y) / (2 * sigma * sigma))
+		}
+	}
+	energy := make([]float64, n)
+	on := make([]bool, n)
+	set := func(p int, v bool) {
+		on[p] = v
+		sign := 1.0
+		if !v {
+			sign = -1
+		}
+		px, py := p%size, p/size
+		for q := range energy {
+			dx, dy := (q%size-px+size)%size, (q/size-py+size)%size
+			energy[q] += sign * kernel[dx+dy*size]
+		}
+	}
+	// tightest is the most crowded point set to v, the largest void when v is false
+	extreme := func(v bool) int {
+		best := -1
+		for p := range energy {
+			if on[p] == v && (best < 0 || v && energy[p] > energy[best] || !v && energy[p] < energy[best]) {
+				best = p
+			}
+		}
+		return best
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	ones := max(1, n/10)
+	for _, p := range rnd.Perm(n)[:ones] {
+		set(p, true)
+	}
+	for i := 0; i < n; i++ { // spread the initial points evenly
+		cluster := extreme(true)
+		set(cluster, false)
+		void := extreme(false)
+		set(void, true)
+		if void == cluster {
+			break
+		}
+	}
+
+	rank := make([]int, n)
+	prototype := append([]bool(nil), on...)
+	saved := append([]float64(nil), energy...)
+	for r := ones - 1; r >= 0; r-- {
+		p := extreme(true)
+		set(p, false)
+		rank[p] = r
+	}
+	copy(on, prototype)
+	copy(energy, saved)
+	for r := ones; r < n; r++ {
+		p := extreme(false)
+		set(p, true)
+		rank[p] = r
+	}
+
+	b := &BlueNoise{Width: size, Height: size, Values: make([]float64, n)}
+	for p, r := range rank {
+		b.Values[p] = (float64(r) + 0.5) / float64(n)
+	}
+	return b
+}
+
+// BlueNoiseFromImage reads a blue noise texture from the gray levels of img.
+func BlueNoiseFromImage(img image.Image) *BlueNoise {
+	r := img.Bounds()
+	b := &BlueNoise{Width: r.Dx(), Height: r.Dy(), Values: make([]float64, r.Dx()*r.Dy())}
+	for y := 0; y < b.Height; y++ {
+		for x := 0; x < b.Width; x++ {
+			g := color.Gray16Model.Convert(img.At(r.Min.X+x, r.Min.Y+y)).(color.Gray16)
+			b.Values[x+y*b.Width] = math.Min(float64(g.Y)/0xffff, math.Nextafter(1, 0))
+		}
+	}
+	return b
+}
@@ -0,0 +1,175 @@
+package tinykaboom
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// Checkpoint saves the progress of the first pass of a render to a file as its tiles are completed, so a
+// crashed or interrupted render can resume without rendering them again. It doesn't record the render
+// parameters: resuming with other ones mixes the two renders.
+type Checkpoint struct {
+	Path   string        // file the progress is saved to, replaced at once so a crash never leaves half of one
+	Every  time.Duration // minimum time between two saves, 0 to only save when the render is interrupted
+	Resume bool          // start from the tiles saved in Path, if it exists
+
+	mu    sync.Mutex
+	frame *Frame
+	size  int // of the tiles
+	tiles []tile
+	done  []bool
+	last  time.Time
+	err   error
+}
+
+const checkpoint_magic = "tinykaboom checkpoint 1\n"
+
+// start attaches the checkpoint to the frame f of the render cfg, loading the pixels of the saved tiles into f
+// and their luminances into cfg.histogram when resuming.
+func (cp *Checkpoint) start(cfg *RenderConfig, f *Frame) error {
+	size := cfg.TileSize
+	if size <= 0 {
+		size = cfg.Width
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.frame, cp.size, cp.tiles, cp.last = f, size, splitTiles(f.Width, f.Height, size), time.Now()
+	cp.done = make([]bool, len(cp.tiles))
+	if !cp.Resume {
+		return nil
+	}
+	file, err := os.Open(cp.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // nothing to resume, the render starts over
+	} else if err != nil {
+		return fmt.Errorf("reading %s: %w", cp.Path, err)
+	}
+	defer file.Close()
+	if err := cp.load(bufio.NewReader(file)); err != nil {
+		return fmt.Errorf("reading %s: %w", cp.Path, err)
+	}
+	for k, t := range cp.tiles {
+		for j := t.y0; j < t.y1 && cp.done[k]; j++ {
+			for i := t.x0; i < t.x1; i++ {
+				cfg.histogram.add(f.Color[i+j*f.Width])
+			}
+		}
+	}
+	return nil
+}
+
+func (cp *Checkpoint) load(r io.Reader) error {
+	magic := make([]byte, len(checkpoint_magic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != checkpoint_magic {
+		return errors.New("not a checkpoint file")
+	}
+	var header [4]uint32
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	want := [4]uint32{uint32(cp.frame.Width), uint32(cp.frame.Height), uint32(cp.size), uint32(len(cp.tiles))}
+	if header != want {
+		return fmt.Errorf("the checkpoint is of a %dx%d render in %d %dx%d tiles, not %dx%d in %d %dx%d tiles",
+			header[0], header[1], header[3], header[2], header[2], want[0], want[1], want[3], want[2], want[2])
+	}
+	done := make([]byte, len(cp.tiles))
+	if _, err := io.ReadFull(r, done); err != nil {
+		return err
+	}
+	var px [4]float64
+	for k, t := range cp.tiles {
+		cp.done[k] = done[k] != 0
+		for j := t.y0; j < t.y1 && cp.done[k]; j++ {
+			for i := t.x0; i < t.x1; i++ {
+				if err := binary.Read(r, binary.LittleEndian, &px); err != nil {
+					return err
+				}
+				cp.frame.Color[i+j*cp.frame.Width], cp.frame.Depth[i+j*cp.frame.Width] = NewVec(px[0], px[1], px[2]), px[3]
+			}
+		}
+	}
+	return nil
+}
+
+// is_done reports whether the tile number k of splitTiles is rendered already, never on a nil checkpoint.
+func (cp *Checkpoint) is_done(k int) bool {
+	if cp == nil {
+		return false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.done[k]
+}
+
+// tile_done records that the tile number k is rendered, saving the checkpoint when it is due.
+func (cp *Checkpoint) tile_done(k int) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.done[k] = true
+	if cp.Every > 0 && time.Since(cp.last) >= cp.Every {
+		cp.err = cp.save_locked()
+	}
+}
+
+// Err returns the error of the last periodic save, the render going on regardless.
+func (cp *Checkpoint) Err() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.err
+}
+
+// save saves the checkpoint now.
+func (cp *Checkpoint) save() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.err = cp.save_locked()
+	return cp.err
+}
+
+// save_locked writes the rendered tiles to a temporary file renamed to cp.Path. The pixels of the tiles
+// recorded done are complete and no longer written to, cp.mu orders their writes before these reads.
+func (cp *Checkpoint) save_locked() error {
+	cp.last = time.Now()
+	tmp := cp.Path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", tmp, err)
+	}
+	w := bufio.NewWriter(file)
+	w.WriteString(checkpoint_magic)
+	f := cp.frame
+	binary.Write(w, binary.LittleEndian, [4]uint32{uint32(f.Width), uint32(f.Height), uint32(cp.size), uint32(len(cp.tiles))})
+	for _, d := range cp.done {
+		if d {
+			w.WriteByte(1)
+		} else {
+			w.WriteByte(0)
+		}
+	}
+	for k, t := range cp.tiles {
+		for j := t.y0; j < t.y1 && cp.done[k]; j++ {
+			for i := t.x0; i < t.x1; i++ {
+				c := f.Color[i+j*f.Width]
+				binary.Write(w, binary.LittleEndian, [4]float64{c.x, c.y, c.z, f.Depth[i+j*f.Width]})
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("writing %s: %w", tmp, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("writing %s: %w", tmp, err)
+	}
+	return os.Rename(tmp, cp.Path)
+}
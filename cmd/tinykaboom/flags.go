@@ -0,0 +1,247 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/holygeek/tinykaboom"
+)
+
+// vecFlag is a flag.Value for vectors given as x,y,z on the command line.
+type vecFlag tinykaboom.Vec
+
+func (f *vecFlag) String() string {
+	v := (*tinykaboom.Vec)(f)
+	return fmt.Sprintf("%g,%g,%g", v.X(), v.Y(), v.Z())
+}
+
+func (f *vecFlag) Set(s string) error {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return fmt.Errorf("want x,y,z, got %q", s)
+	}
+	var c [3]float64
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return err
+		}
+		c[i] = v
+	}
+	*f = vecFlag(*tinykaboom.NewVec(c[0], c[1], c[2]))
+	return nil
+}
+
+// vecsFlag is a flag.Value for a list of vectors, each given as x,y,z by one occurrence of the flag. The
+// first occurrence replaces the default list.
+type vecsFlag struct {
+	vecs []*tinykaboom.Vec
+	set  bool
+}
+
+func (f *vecsFlag) String() string {
+	var parts []string
+	for _, v := range f.vecs {
+		parts = append(parts, (*vecFlag)(v).String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f *vecsFlag) Set(s string) error {
+	var v vecFlag
+	if err := v.Set(s); err != nil {
+		return err
+	}
+	if !f.set {
+		f.vecs, f.set = nil, true
+	}
+	f.vecs = append(f.vecs, (*tinykaboom.Vec)(&v))
+	return nil
+}
+
+// curvesFlag is a flag.Value for the tone curves of the red, green and blue channels given as their
+// lift,gamma,gain triples separated by slashes, like 0,1,1/0,1,1/0.05,1.1,1. A single triple grades the three
+// channels alike.
+type curvesFlag [3]tinykaboom.ToneCurve
+
+func (f *curvesFlag) String() string {
+	var parts []string
+	for _, c := range f {
+		parts = append(parts, fmt.Sprintf("%g,%g,%g", c.Lift, c.Gamma, c.Gain))
+	}
+	if f[0] == f[1] && f[1] == f[2] {
+		parts = parts[:1]
+	}
+	return strings.Join(parts, "/")
+}
+
+func (f *curvesFlag) Set(s string) error {
+	triples := strings.Split(s, "/")
+	if len(triples) != 1 && len(triples) != 3 {
+		return fmt.Errorf("want lift,gamma,gain for all the channels or r/g/b triples, got %q", s)
+	}
+	var curves [3]tinykaboom.ToneCurve
+	for i, t := range triples {
+		var vf vecFlag
+		if err := vf.Set(t); err != nil {
+			return fmt.Errorf("want lift,gamma,gain, got %q", t)
+		}
+		v := (*tinykaboom.Vec)(&vf)
+		if !(v.Y() > 0) {
+			return fmt.Errorf("the gamma of a curve must be positive, got %g", v.Y())
+		}
+		curves[i] = tinykaboom.ToneCurve{Lift: v.X(), Gamma: v.Y(), Gain: v.Z()}
+	}
+	if len(triples) == 1 {
+		curves[1], curves[2] = curves[0], curves[0]
+	}
+	*f = curves
+	return nil
+}
+
+// seedFlag is a flag.Value for the noise seed, given as a number or as any other word, hashed with FNV-1a to a
+// whole number so the same word always gives the same explosion.
+type seedFlag float64
+
+func (f *seedFlag) String() string {
+	return strconv.FormatFloat(float64(*f), 'g', -1, 64)
+}
+
+func (f *seedFlag) Set(s string) error {
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		*f = seedFlag(v)
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	*f = seedFlag(h.Sum32())
+	return nil
+}
+
+const byteUnits = "KMGT"
+
+// byteSize is a flag.Value for memory sizes given in bytes or with a K, M, G or T binary suffix, like 512M.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return format_bytes(float64(*b))
+}
+
+func (b *byteSize) Set(s string) error {
+	num, shift := s, 0
+	if n := len(num); n > 0 {
+		if k := strings.IndexByte(byteUnits, num[n-1]&^0x20); k >= 0 { // either case
+			num, shift = num[:n-1], 10*(k+1)
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("want a size like 512M or 2G, got %q", s)
+	}
+	*b = byteSize(v * float64(int64(1)<<shift))
+	return nil
+}
+
+// flagVec defines a x,y,z vector flag with the given default, like flag.String does for strings.
+func flagVec(name string, value *tinykaboom.Vec, usage string) *tinykaboom.Vec {
+	v := *value
+	flag.Var((*vecFlag)(&v), name, usage)
+	return &v
+}
+
+// flagVecs defines a repeatable x,y,z vector flag, the given vectors by default.
+func flagVecs(name string, value []*tinykaboom.Vec, usage string) *[]*tinykaboom.Vec {
+	f := &vecsFlag{vecs: value}
+	flag.Var(f, name, usage)
+	return &f.vecs
+}
+
+// flagCurves defines a tone curves flag, the identity curves by default.
+func flagCurves(name string, usage string) *curvesFlag {
+	c := curvesFlag{tinykaboom.IdentityCurve, tinykaboom.IdentityCurve, tinykaboom.IdentityCurve}
+	flag.Var(&c, name, usage)
+	return &c
+}
+
+// flagSeed defines a noise seed flag with the given default.
+func flagSeed(name string, value float64, usage string) *float64 {
+	v := seedFlag(value)
+	flag.Var(&v, name, usage)
+	return (*float64)(&v)
+}
+
+// flagBytes defines a memory size flag with the given default in bytes.
+func flagBytes(name string, value int64, usage string) *byteSize {
+	b := byteSize(value)
+	flag.Var(&b, name, usage)
+	return &b
+}
+
+// envPrefix starts the names of the environment variables setting the flags, TINYKABOOM_SEED for -seed.
+const envPrefix = "TINYKABOOM_"
+
+// envName returns the environment variable of the flag name: envPrefix followed by the name in upper case, its
+// dashes turned into underscores.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// flagsFromEnv sets the flags missing from the command line from their environment variables, so the command
+// line overrides the environment, which overrides the defaults. It must be called after flag.Parse. The flags
+// it sets count as set for flagSet.
+func flagsFromEnv() error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		if serr := flag.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", v, envName(f.Name), serr)
+		}
+	})
+	return err
+}
+
+// flagSet reports whether the flag name was set, on the command line or in the environment.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
+}
+
+// checkFrameTemplate checks that the printf template t has exactly one verb and that it formats an integer.
+func checkFrameTemplate(t string) error {
+	verbs := 0
+	for i := 0; i < len(t); i++ {
+		if t[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(t) && strings.IndexByte("+-# 0123456789", t[i]) >= 0 { // flags and width
+			i++
+		}
+		switch {
+		case i == len(t):
+			return fmt.Errorf("output template %q ends in the middle of a verb", t)
+		case t[i] == '%':
+			if t[i-1] != '%' {
+				return fmt.Errorf("output template %q has a malformed %%%% escape", t)
+			}
+		case strings.IndexByte("bdoxX", t[i]) >= 0:
+			verbs++
+		default:
+			return fmt.Errorf("output template %q has a %%%c verb, only integer verbs are allowed", t, t[i])
+		}
+	}
+	if verbs != 1 {
+		return fmt.Errorf("output template %q needs exactly one integer verb for the frame number, it has %d", t, verbs)
+	}
+	return nil
+}
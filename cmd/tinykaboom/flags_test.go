@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+// TestFlagsFromEnv checks the command line overrides the environment, which overrides the defaults.
+func TestFlagsFromEnv(t *testing.T) {
+	evolve0, lightOrbit0, tileSize0 := *evolve, *lightOrbit, *tileSize
+	parsed := flag.CommandLine
+	t.Cleanup(func() { // the values back, and a parsed flag set with the same flags none of which is set
+		*evolve, *lightOrbit, *tileSize = evolve0, lightOrbit0, tileSize0
+		fresh := flag.NewFlagSet(parsed.Name(), parsed.ErrorHandling())
+		parsed.VisitAll(func(f *flag.Flag) { fresh.Var(f.Value, f.Name, f.Usage) })
+		fresh.Parse(nil) // the testing package wants flag.Parsed
+		flag.CommandLine = fresh
+	})
+	t.Setenv(envName("evolve"), "3")
+	t.Setenv(envName("light-orbit"), "0.5")
+	if err := flag.CommandLine.Parse([]string{"-evolve", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := flagsFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+		set  bool
+	}{
+		{"evolve", *evolve, 2, true},            // the flag over the environment
+		{"light-orbit", *lightOrbit, 0.5, true}, // the environment over the default
+		{"ambient", *ambient, 0.4, false},       // the default
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("-%s is %g, want %g", tt.name, tt.got, tt.want)
+		}
+		if flagSet(tt.name) != tt.set {
+			t.Errorf("flagSet(%q) is %t, want %t", tt.name, !tt.set, tt.set)
+		}
+	}
+
+	t.Setenv(envName("tile-size"), "big")
+	if err := flagsFromEnv(); err == nil || !strings.Contains(err.Error(), envName("tile-size")) {
+		t.Errorf("flagsFromEnv with %s=big returned %v, want an error naming the variable", envName("tile-size"), err)
+	}
+}
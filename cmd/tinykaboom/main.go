@@ -0,0 +1,902 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/holygeek/tinykaboom"
+)
+
+type outputFormat struct {
+	ext       string // file name extension
+	write     func(w io.Writer, framebuffer []*tinykaboom.Vec, width, height int) error
+	quantized bool // the channels are truncated to 8 bits
+	buffered  int  // bytes per pixel the encoder holds in memory before writing them out
+}
+
+// checkpointPath is the file -checkpoint saves the rendered tiles to.
+const checkpointPath = "./out-go.checkpoint"
+
+// formats maps the -format names to the framebuffer encoders.
+var formats = map[string]outputFormat{
+	"ppm":     {"ppm", tinykaboom.WritePPM, true, 0},
+	"png":     {"png", tinykaboom.WritePNG, true, 4},       // an image.RGBA
+	"exr":     {"exr", tinykaboom.WriteEXR, false, 2 * 12}, // a bytes.Buffer grown by doubling
+	"raw-f32": {"f32", tinykaboom.WriteRawF32, false, 2 * 12},
+}
+
+var (
+	imgWidth   = flag.Int("width", 640, "image width in `pixels`")
+	imgHeight  = flag.Int("height", 480, "image height in `pixels`")
+	fovDegrees = flag.Float64("fov", 60, "vertical field of view in `degrees`")
+	outPath    = flag.String("out", "", "write the image to `file`, or to the standard output for -, ./out-go.<format extension> by default")
+	cpuprofile = flag.String("cpuprofile", "", "write a cpu profile of the render to `file`")
+	memprofile = flag.String("memprofile", "", "write a memory profile taken after the render to `file`")
+	tileSize   = flag.Int("tile-size", 32, "render the image in `N`xN pixel tiles")
+	maxMemory  = flagBytes("max-memory", available_memory(), "refuse to start the renders estimated to need more than `size` of memory, like 512M or 2G, 0 for no limit")
+	workers    = flag.Int("workers", 0, "render with `N` goroutines, one per CPU when 0")
+	ckptEvery  = flag.Float64("checkpoint", 0, "save the rendered tiles to ./out-go.checkpoint every `seconds`, and when interrupted, for -resume to pick up from; 0 to only save when interrupted with -resume")
+	resume     = flag.Bool("resume", false, "skip the tiles saved in ./out-go.checkpoint by an earlier -checkpoint render with the same parameters")
+	bg         = flag.String("bg", "flat", "background of the rays that miss the explosion: flat or stars")
+	maskImage  = flag.String("mask", "", "only trace the rays through the white pixels of the PNG or JPEG `file`, stretched over the image")
+	bgImage    = flag.String("bg-image", "", "PNG or JPEG `file` stretched over the image behind the explosion")
+	compOver   = flag.String("composite-over", "", "composite the explosion over the PNG or JPEG `file` of the size of the image, source-over with the fraction of the antialiasing samples of each pixel hitting the explosion as alpha; the grading flags apply to the combined image, and it can't go with -bg-image")
+	depthOut   = flag.String("depth", "", "write the distance from the camera of every pixel to the PGM `file` as well, white for the nearest and black for the rays missing everything")
+	colorSpace = flag.String("color-space", "linear", "encoding of the output values: linear writes them as rendered, srgb applies the sRGB transfer function after the grading, gamma a plain 1/2.2 power")
+	bitDepth   = flag.String("bits", "8", "bits per channel of the ppm output: 8, 16, or auto for 16 when the image has gradients smooth enough to band in 8 bits")
+	endian     = flag.String("endian", "little", "byte order of the raw-f32 output: little, or big")
+	format     = flag.String("format", "ppm", "output format: ppm, png, or exr or raw-f32 for the unclamped linear values")
+	reference  = flag.String("compare", "", "compare the image to the reference PPM `file`, testdata/tinykaboom-cpp.ppm is the output of the C++ tinykaboom")
+	tolerance  = flag.Int("tolerance", 16, "channel `difference` up to which -compare considers two pixels the same")
+	mismatches = flag.Float64("max-mismatch", 0.02, "`fraction` of the pixels that may differ before -compare fails")
+	replMode   = flag.Bool("repl", false, "render the image, then read commands like seed 5 or render from stdin to change the parameters and render again, help lists them")
+	writeMeta  = flag.Bool("write-metadata", false, "write the render parameters and the flags next to every image, in a JSON file of the same name")
+	bracket    = flag.Bool("bracket", false, "write the image exposed -2, 0 and +2 stops, from a single render, to the -out file name with _-2, _0 and _+2 before its extension")
+	showProg   = flag.Bool("progress", false, "print the percentage of the pixels rendered to stderr 4 times per second, and the render time when done")
+	benchRuns  = flag.Int("benchmark", 0, "render the image `N` times without writing it and print the render time percentiles to stderr")
+	traceAt    = flag.String("trace-debug", "", "print how the ray through the pixel `x,y`, counted from the top left corner, is shaded to stderr after rendering the image")
+	dryRun     = flag.Bool("dry-run", false, "check the parameters and print the resolved scene and render settings to stderr without rendering")
+	stats      = flag.Bool("stats", false, "print render statistics to stderr")
+	aaMode     = flag.String("aa", "none", "antialiasing: none, adaptive to supersample the high contrast pixels only, depth to supersample the depth discontinuities only, edge-mask to supersample the outline against the background only or full to supersample every pixel with jittered samples, -aa-samples² times slower")
+	aaSamples  = flag.Int("aa-samples", 3, "supersample the antialiased pixels with a `N`xN grid of rays")
+	aaContrast = flag.Float64("aa-threshold", 0.1, "`difference` between neighbors above which a pixel is refined: of luminance for -aa adaptive, of depth for -aa depth")
+	ssaa       = flag.Int("ssaa", 1, "render at `N` times the resolution and box filter down, costs N² times the time and memory")
+	cacheNoise = flag.Bool("noise-cache", false, "cache the noise lattice hashes in each worker, same image with fewer math.Sin calls")
+	vecPool    = flag.Bool("vec-pool", false, "recycle the vectors of each ray instead of leaving them to the garbage collector, same image; it pays off with the -sdf shapes in long animations")
+	blueNoise  = flag.String("blue-noise-mask", "", "dither the 8-bit output and jitter the antialiasing samples with the blue noise of the gray PNG `file`, or of a generated texture for \"builtin\"")
+	progRender = flag.Bool("progressive", false, "render the -aa-samples² samples of every pixel one pass at a time, writing the image after each pass")
+	aaJitter   = flag.Bool("aa-jitter", false, "jitter the antialiasing samples randomly inside their cells of the grid, reproducibly for a -supersample-seed; the default with -aa full")
+	jitterSeed = flag.Uint64("supersample-seed", 0, "`seed` of the -aa-jitter sample offsets")
+	cheapAA    = flag.Bool("cheap-aa", false, "light the antialiased pixels once instead of at every sample, faster but only the edges get smoothed")
+	atTime     = flag.Float64("time", 0, "render the explosion `t` seconds into the animation")
+	frames     = flag.Int("frames", 0, "render an animation of `N` frames instead of a single image")
+	fps        = flag.Float64("fps", 24, "frame `rate` of the -frames animation, its time advancing 1/rate seconds per frame")
+	frameRange = flag.String("frame-range", "", "render only the frames `start,end` of the -frames animation, from start up to end excluded")
+	encoders   = flag.Int("encoders", 2, "write up to `N` frames of an animation at once while the next one renders")
+	frameNames = flag.String("output-template", "", "printf `template` of the animation frame file names, frame_%04d.<format extension> by default")
+	sdfName    = flag.String("sdf", "fireball", "shape displaced by the noise: fireball, box or torus")
+	noDiscard  = flag.Bool("no-early-discard", false, "march the rays missing the bounding sphere of the explosion too, slower but for the shapes extending beyond it")
+	noiseKind  = flag.String("noise", "value", "noise displacing the surface: value, the original, or gradient for Perlin's noise without the lattice streaks")
+	noiseDims  = flag.Int("noise-dims", 3, "`dimensions` of the noise displacing the surface: 3, or 2 for noise constant along one axis of the noise field, streaking the flames along it (see -rotate)")
+	noiseFreq  = flag.Float64("noise-frequency", tinykaboom.DefaultNoiseFrequency, "noise cells per unit of the noise displacing the surface, higher for finer, more turbulent flames")
+	radius     = flag.Float64("radius", tinykaboom.DefaultRadius, "scale the shape to fit in a sphere of the given `radius`")
+	amplitude  = flag.Float64("amplitude", tinykaboom.DefaultNoiseAmplitude, "how far the noise carves into the shape, higher for flames reaching further")
+	noisePer   = flag.Int("noise-period", 0, "make the noise field tile every `N` units along its axes, 0 for no tiling")
+	montage    = flag.String("seed-montage", "", "render a contact sheet of `cols,rows` explosions of consecutive seeds starting at -seed, each labelled with its seed")
+	seedSearch = flag.Int("seed-search", 0, "try the `K` seeds from -seed at a quarter of the resolution and render the one with the most contrasted explosion, printing it to stderr")
+	seed       = flagSeed("seed", 0, "`seed` of the noise pattern, each integer gives a different explosion; a word is hashed to one, like -seed dragon")
+	evolve     = flag.Float64("evolve", 0, "advance the seed by `rate` per second so the flames churn as they rise")
+	normalMode = flag.String("normal-mode", "shading", "shading normal: shading for the one of the noisy surface, geometric for the one of the undisplaced shape, or a `blend` in [0,1] from one to the other")
+	lightOrbit = flag.Float64("light-orbit", 0, "orbit the light around the vertical axis `speed` turns per second, sweeping the highlights over an animation")
+	shadowK    = flag.Float64("shadow", 0, "cast the shadows of the explosion from the point light, with penumbrae of `sharpness` K: about 8 for soft shadows, hundreds for hard ones; 0 for none")
+	lightSize  = flag.Float64("light-size", 0, "make the point lights spheres of `radius` R for -shadow, so the shadows get penumbrae as wide as the light is large; 0 for hard shadows")
+	lightRays  = flag.Int("light-samples", 0, "shadow rays towards each light of -light-size, `N` jittered points in its sphere; 0 for 16")
+	ambient    = flag.Float64("ambient", 0.4, "minimum light `intensity` of the surface, in [0,1]")
+	invertPal  = flag.Bool("invert-palette", false, "look the palette up backwards, so the hot colors are on the outside")
+	palName    = flag.String("palette", "fire", "colors of the explosion: fire, ice or nebula")
+	palSmooth  = flag.Bool("palette-smooth", false, "interpolate the palette colors with a spline instead of linearly, without creases at the stops")
+	palBands   = flag.Int("palette-bands", 0, "posterize the palette into `N` flat bands, 0 for a continuous gradient")
+	palPreview = flag.String("palette-preview", "", "write the palette as seen in the image, with -palette-gamma and -invert-palette and graded like the image by -tonemap, -contrast, -rgb-curve, -color-space and the other grading flags, to the PNG `file` instead of rendering")
+	palGamma   = flag.Float64("palette-gamma", 1, "look the palette up at d^`g`, the distance d into the fireball in [0,1]; below 1 the hot colors spread further out")
+	palCycle   = flag.Float64("palette-cycle", 0, "cycle the colors through the palette `speed` times per second")
+	motionBlur = flag.Int("motion-blur", 1, "average `samples` renders evenly spread over the shutter interval")
+	shutter    = flag.Float64("shutter", 1.0/24, "duration of the shutter interval in `seconds`")
+	debugMode  = flag.String("debug", "none", "diagnostic rendering: none, steps for a heatmap of the ray march iterations, or clip to show the pixels of the graded image above 1 in red and below 0 in blue")
+	clampNeg   = flag.Bool("clamp-negative", false, "set the negative color channels to 0 after the grading, before they reach the output format")
+	stereo     = flag.Bool("stereo", false, "render the views of the left and right eyes side by side in a double width image")
+	anaglyph3d = flag.Bool("anaglyph", false, "combine the views of the left and right eyes into a red/cyan anaglyph")
+	ipd        = flag.Float64("ipd", 0.1, "`distance` between the eyes of the stereo views")
+	roll       = flag.Float64("roll", 0, "turn the camera counterclockwise about its view axis by `degrees`, tilting the horizon")
+	pixAspect  = flag.Float64("pixel-aspect", 1, "width over height of the pixels of the display, like 0.9 for NTSC DVD, so the explosion stays round on it; -fov remains the vertical field of view")
+	zoom       = flag.Float64("zoom", 1, "magnify the center of the image by `factor` without moving the camera")
+	projection = flag.String("projection", "perspective", "camera projection: perspective, or cylindrical for a panorama sweeping -hfov around the camera")
+	hfov       = flag.Float64("hfov", 180, "horizontal field of view of the cylindrical projection in `degrees`")
+	rgbCurves  = flagCurves("rgb-curve", "grade the channels with the lift,gamma,gain `curves`, one triple for all the channels or r/g/b triples separated by slashes")
+	radialBlur = flag.Float64("radial-blur", 0, "streak the image outwards from its center, blurring each pixel over `strength` times its distance to the center")
+	vignetteK  = flag.Float64("vignette", 0, "darken the image towards the edges, by `strength` in the corners")
+	grain      = flag.Float64("grain", 0, "add film grain of the given `amount`, changing with every frame of an animation")
+	cropFit    = flag.Bool("crop-to-content", false, "trim the image to the bounding box of the explosion")
+	flipH      = flag.Bool("flip-h", false, "mirror the output image left to right")
+	flipV      = flag.Bool("flip-v", false, "mirror the output image top to bottom")
+	fireflies  = flag.Bool("firefly-reject", false, "replace the isolated pixels much brighter than their neighbors by the median of the neighborhood")
+	denoise    = flag.Float64("denoise", 0, "smooth the image with an edge-aware filter of the given `strength`, 0 disables it")
+	autoExpose = flag.Bool("auto-exposure", false, "scale the colors to bring the average luminance of the image to mid-gray")
+	toneMap    = flag.String("tonemap", "none", "compress the highlights into the displayable range with a curve: none, reinhard, aces, or reinhard-gamma for reinhard followed by the 1/2.2 gamma of -color-space gamma")
+	contrastK  = flag.Float64("contrast", 1, "scale the color channels away from mid-gray by `factor`, 1 leaves the image as is")
+	camPos     = flagVec("cam", tinykaboom.NewVec(0, 0, 3), "position `x,y,z` of the camera, which looks along the -z axis")
+	lights     = flagVecs("light", []*tinykaboom.Vec{tinykaboom.NewVec(10, 10, 10)}, "position `x,y,z` of a point light, at time 0 with -light-orbit; repeat it for several lights")
+	center     = flagVec("center", tinykaboom.NewVec(0, 0, 0), "place the center of the explosion at `x,y,z`")
+	spotPos    = flagVec("spot", tinykaboom.NewVec(-4, 0, 3), "position `x,y,z` of the spotlight enabled by -spot-angle")
+	spotDir    = flagVec("spot-dir", tinykaboom.NewVec(4, 0, -3), "direction `x,y,z` the spotlight points to")
+	spotAngle  = flag.Float64("spot-angle", 0, "half-angle of the spotlight cone in `degrees`, 0 for no spotlight")
+	spotSoft   = flag.Float64("spot-falloff", 5, "width of the soft edge of the spotlight cone in `degrees`")
+	floor      = flag.Bool("floor-checker", false, "put a matte checkerboard floor under the explosion")
+	floorY     = flag.Float64("floor-height", -1.5, "`y` coordinate of the -floor-checker plane")
+	floorA     = flagVec("floor-color-a", tinykaboom.NewVec(0.9, 0.9, 0.9), "`r,g,b` color of half of the floor squares")
+	floorB     = flagVec("floor-color-b", tinykaboom.NewVec(0.2, 0.2, 0.2), "`r,g,b` color of the other floor squares")
+	sparks     = flag.Int("sparks", 0, "throw `N` glowing sparks out of the fireball, flying with the animation time")
+	fogDensity = flag.Float64("fog", 0, "fill the bottom of the scene with a ground fog of the given `density` at -fog-height, 0 for no fog")
+	fogHeight  = flag.Float64("fog-height", -1, "`y` coordinate where the fog has the -fog density")
+	fogFalloff = flag.Float64("fog-falloff", 0.5, "`height` over which the fog thins out by a factor e")
+	fogColor   = flagVec("fog-color", tinykaboom.NewVec(0.6, 0.6, 0.65), "`r,g,b` color of the fog")
+	floorTile  = flag.Float64("floor-tile", 0.5, "`size` of the floor squares")
+	rotation   = flagVec("rotate", tinykaboom.NewVec(0, 0, 0), "rotate the noise field by the `x,y,z` angles in degrees")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nThe flags missing from the command line are taken from the environment, %s for -seed.\n", envName("seed"))
+	}
+	flag.Parse()
+	if err := flagsFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+
+	width, height := *imgWidth, *imgHeight
+	if width <= 0 || height <= 0 {
+		log.Fatalf("the image size must be positive, got %dx%d", width, height)
+	}
+	if !(*fovDegrees > 0 && *fovDegrees < 180) {
+		log.Fatalf("the field of view must be in (0,180) degrees, got %g", *fovDegrees)
+	}
+	fov := *fovDegrees / 60 * (math.Pi / 3) // the default is exactly the former constant π/3, not an ulp off it
+
+	background, ok := tinykaboom.Backgrounds[*bg]
+	if !ok {
+		log.Fatalf("unknown background %q", *bg)
+	}
+	var backdrop image.Image
+	if *bgImage != "" {
+		img, err := loadImage(*bgImage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backdrop = img
+	}
+	var underlay image.Image
+	if *compOver != "" {
+		img, err := loadImage(*compOver)
+		if err != nil {
+			log.Fatal(err)
+		}
+		underlay = img
+	}
+	var stencil image.Image
+	if *maskImage != "" {
+		img, err := loadImage(*maskImage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		stencil = img
+	}
+	var mask *tinykaboom.BlueNoise
+	switch *blueNoise {
+	case "":
+	case "builtin":
+		mask = tinykaboom.NewBlueNoise(64)
+	default:
+		img, err := loadImage(*blueNoise)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mask = tinykaboom.BlueNoiseFromImage(img)
+	}
+	if *noiseKind != "value" && *noiseKind != "gradient" {
+		log.Fatalf("unknown noise %q, want value or gradient", *noiseKind)
+	}
+	if *radius <= 0 {
+		log.Fatalf("the radius must be positive, got %g", *radius)
+	}
+	if *noiseFreq <= 0 || *amplitude <= 0 {
+		log.Fatalf("the noise frequency and amplitude must be positive, got %g and %g", *noiseFreq, *amplitude)
+	}
+	if *pixAspect <= 0 {
+		log.Fatalf("the pixel aspect ratio must be positive, got %g", *pixAspect)
+	}
+	if *pixAspect != 1 && *projection != "perspective" {
+		log.Fatal("-pixel-aspect only applies to the perspective projection")
+	}
+	if *zoom <= 0 {
+		log.Fatalf("the zoom factor must be positive, got %g", *zoom)
+	}
+	if *vignetteK < 0 {
+		log.Fatalf("the vignette strength can't be negative, got %g", *vignetteK)
+	}
+	if !(*radialBlur >= 0 && *radialBlur <= 1) {
+		log.Fatalf("the radial blur strength must be in [0,1], got %g", *radialBlur)
+	}
+	if *grain < 0 {
+		log.Fatalf("the film grain amount can't be negative, got %g", *grain)
+	}
+	if *contrastK < 0 {
+		log.Fatalf("the contrast factor can't be negative, got %g", *contrastK)
+	}
+	aa, ok := tinykaboom.AAModes[*aaMode]
+	if !ok {
+		log.Fatalf("unknown antialiasing mode %q", *aaMode)
+	}
+	if *aaSamples <= 0 {
+		log.Fatalf("the number of antialiasing samples must be positive, got %d", *aaSamples)
+	}
+	if *aaJitter && *blueNoise != "" {
+		log.Fatal("-aa-jitter and -blue-noise-mask both set the antialiasing sample offsets")
+	}
+	jitter := *aaJitter
+	if aa == tinykaboom.AAFull && *blueNoise == "" && !flagSet("aa-jitter") {
+		jitter = true // the regular grid of samples aliases the fine noise over the whole image
+	}
+	if *ssaa < 1 {
+		log.Fatalf("the supersampling factor must be at least 1, got %d", *ssaa)
+	}
+	if *motionBlur < 1 {
+		log.Fatalf("the number of motion blur samples must be at least 1, got %d", *motionBlur)
+	}
+	if !(*fps > 0) || math.IsInf(*fps, 0) {
+		log.Fatalf("the frame rate must be positive, got %g", *fps)
+	}
+	if *frames < 0 {
+		log.Fatalf("the number of frames can't be negative, got %d", *frames)
+	}
+	first, end := 0, *frames
+	if *frameRange != "" {
+		if _, err := fmt.Sscanf(*frameRange, "%d,%d", &first, &end); err != nil {
+			log.Fatalf("invalid -frame-range %q, want start,end", *frameRange)
+		}
+		if !(0 <= first && first < end && end <= *frames) {
+			log.Fatalf("the frame range [%d,%d) isn't inside the %d frames of the animation", first, end, *frames)
+		}
+	}
+	if *ckptEvery < 0 {
+		log.Fatalf("the checkpoint interval can't be negative, got %g", *ckptEvery)
+	}
+	if (*ckptEvery > 0 || *resume) && (*frames > 0 || *progRender || *montage != "" || *benchRuns > 0) {
+		log.Fatal("-checkpoint and -resume only apply to the render of a single image")
+	}
+	var traceX, traceY int
+	if *traceAt != "" {
+		if _, err := fmt.Sscanf(*traceAt, "%d,%d", &traceX, &traceY); err != nil {
+			log.Fatalf("invalid -trace-debug %q, want x,y", *traceAt)
+		}
+		if traceX < 0 || traceY < 0 || traceX >= width || traceY >= height {
+			log.Fatalf("the traced pixel %d,%d is outside the %dx%d image", traceX, traceY, width, height)
+		}
+	}
+	if *showProg && (*frames > 0 || *progRender || *replMode || *benchRuns > 0) {
+		log.Fatal("-progress only applies to the render of a single image or of a -seed-montage")
+	}
+	if *replMode && (*frames > 0 || *progRender || *montage != "" || *benchRuns > 0 || *bracket) {
+		log.Fatal("-repl only applies to the render of a single image")
+	}
+	if *bracket && (*frames > 0 || *progRender || *montage != "" || *benchRuns > 0 || *reference != "") {
+		log.Fatal("-bracket only applies to the render of a single image, without -compare")
+	}
+	if *depthOut != "" && (*frames > 0 || *bracket) {
+		log.Fatal("-depth writes the depth of a single image, not of the -frames or the -bracket exposures")
+	}
+	if *outPath == "-" && (*replMode || *progRender || *bracket || *writeMeta) {
+		log.Fatal("-out - writes a single image to the standard output, not the several of -repl, -progressive or -bracket nor a -write-metadata sidecar")
+	}
+	if *seedSearch < 0 {
+		log.Fatalf("the number of seeds to search can't be negative, got %d", *seedSearch)
+	}
+	if *seedSearch > 0 && *montage != "" {
+		log.Fatal("-seed-search and -seed-montage both pick the seeds")
+	}
+	if *encoders < 1 {
+		log.Fatalf("at least one frame must be written at a time, got -encoders %d", *encoders)
+	}
+	sdf, ok := tinykaboom.SDFs[*sdfName]
+	if !ok {
+		log.Fatalf("unknown shape %q", *sdfName)
+	}
+	smoothNormal := 0.0
+	switch *normalMode {
+	case "shading":
+	case "geometric":
+		smoothNormal = 1
+	default:
+		v, err := strconv.ParseFloat(*normalMode, 64)
+		if err != nil || !(v >= 0 && v <= 1) {
+			log.Fatalf("invalid -normal-mode %q, want shading, geometric or a blend in [0,1]", *normalMode)
+		}
+		smoothNormal = v
+	}
+	gradient, ok := tinykaboom.Palettes[*palName]
+	if !ok {
+		log.Fatalf("unknown palette %q", *palName)
+	}
+	proj, ok := tinykaboom.Projections[*projection]
+	if !ok {
+		log.Fatalf("unknown projection %q", *projection)
+	}
+	debug, ok := tinykaboom.DebugModes[*debugMode]
+	if !ok {
+		log.Fatalf("unknown debug mode %q", *debugMode)
+	}
+	curve, ok := tinykaboom.ToneMaps[*toneMap]
+	if !ok {
+		log.Fatalf("unknown tone mapping %q", *toneMap)
+	}
+	out, ok := formats[*format]
+	if !ok {
+		log.Fatalf("unknown format %q", *format)
+	}
+	switch {
+	case *endian == "little":
+	case *endian != "big":
+		log.Fatalf("unknown byte order %q", *endian)
+	case *format != "raw-f32":
+		log.Fatal("only the raw-f32 format can be written big-endian")
+	default:
+		out.write = tinykaboom.WriteRawF32BE
+	}
+	switch {
+	case *bitDepth == "8":
+	case *bitDepth != "16" && *bitDepth != "auto":
+		log.Fatalf("unknown bit depth %q, want 8, 16 or auto", *bitDepth)
+	case *format != "ppm":
+		log.Fatal("only the ppm format can be written with 16 bits per channel")
+	case *bitDepth == "16":
+		out.write, out.quantized = tinykaboom.WritePPM16, false
+	}
+	space, ok := tinykaboom.ColorSpaces[*colorSpace]
+	if !ok {
+		log.Fatalf("unknown color space %q", *colorSpace)
+	}
+	imagePath := *outPath
+	if imagePath == "" {
+		imagePath = "./out-go." + out.ext
+	}
+	if *frameNames == "" {
+		*frameNames = "frame_%04d." + out.ext
+	}
+	if err := checkFrameTemplate(*frameNames); err != nil {
+		log.Fatal(err)
+	}
+
+	scene := tinykaboom.NewScene()
+	scene.Time = *atTime
+	scene.Center = center
+	scene.Camera = camPos
+	scene.Lights = *lights
+	scene.PaletteCycle = *palCycle
+	scene.InvertPalette = *invertPal
+	scene.PaletteGamma = *palGamma
+	scene.SmoothPalette = *palSmooth
+	palette := *gradient
+	palette.Smooth = *palSmooth
+	scene.Palette = palette.Color
+	scene.PaletteBands = *palBands
+	scene.Ambient = *ambient
+	scene.Shadow = *shadowK
+	scene.LightSize = *lightSize
+	scene.LightSamples = *lightRays
+	scene.Seed = *seed
+	scene.NoiseDims = *noiseDims
+	scene.GradientNoise = *noiseKind == "gradient"
+	scene.NoisePeriod = *noisePer
+	scene.NoiseFreq = *noiseFreq
+	scene.Radius = *radius
+	scene.NoiseAmp = *amplitude
+	scene.Evolve = *evolve
+	scene.Roll = *roll * math.Pi / 180
+	if *sdfName != "fireball" { // left nil, signed_distance calls sdf_fireball directly
+		scene.SDF = sdf
+	}
+	scene.NoDiscard = *noDiscard
+	scene.LightOrbit = *lightOrbit
+	scene.SmoothNormal = smoothNormal
+	scene.Sparks = *sparks
+	if *spotAngle != 0 {
+		const deg = math.Pi / 180
+		scene.SpotLights = append(scene.SpotLights, tinykaboom.SpotLight{
+			Position:  spotPos,
+			Direction: spotDir,
+			Angle:     *spotAngle * deg,
+			Falloff:   *spotSoft * deg,
+		})
+	}
+	if *floor {
+		scene.Floor = &tinykaboom.Floor{Height: *floorY, Colors: [2]*tinykaboom.Vec{floorA, floorB}, Tile: *floorTile}
+	}
+	if *fogDensity != 0 {
+		scene.Fog = &tinykaboom.Fog{Density: *fogDensity, Height: *fogHeight, Falloff: *fogFalloff, Color: fogColor}
+	}
+	if *rotation != (tinykaboom.Vec{}) {
+		const deg = math.Pi / 180
+		scene.NoiseRotation = tinykaboom.RotationXYZ(rotation.X()*deg, rotation.Y()*deg, rotation.Z()*deg).Mul(scene.NoiseRotation)
+	}
+
+	cfg := tinykaboom.RenderConfig{
+		Scene: scene,
+
+		Width:       width,
+		Height:      height,
+		FOV:         fov,
+		Zoom:        *zoom,
+		PixelAspect: *pixAspect,
+		Projection:  proj,
+		HFOV:        *hfov * math.Pi / 180,
+		TileSize:    *tileSize,
+		Workers:     *workers,
+
+		AA:          aa,
+		AASamples:   *aaSamples,
+		AAThreshold: *aaContrast,
+		CheapAA:     *cheapAA,
+		BlueNoise:   mask,
+		Jitter:      jitter,
+		JitterSeed:  *jitterSeed,
+		NoiseCache:  *cacheNoise,
+		VecPool:     *vecPool,
+		SSAA:        *ssaa,
+
+		MotionBlur: *motionBlur,
+		Shutter:    *shutter,
+		FPS:        *fps,
+
+		Background: background,
+		Backdrop:   backdrop,
+		Mask:       stencil,
+
+		CompositeOver: underlay,
+
+		Debug: debug,
+
+		IPD: *ipd,
+	}
+	if *ckptEvery > 0 || *resume {
+		cfg.Checkpoint = &tinykaboom.Checkpoint{Path: checkpointPath, Every: time.Duration(*ckptEvery * float64(time.Second)), Resume: *resume}
+	}
+	switch {
+	case *stereo && *anaglyph3d:
+		log.Fatal("-stereo and -anaglyph are mutually exclusive")
+	case *stereo:
+		cfg.Stereo = tinykaboom.StereoSideBySide
+	case *anaglyph3d:
+		cfg.Stereo = tinykaboom.StereoAnaglyph
+	}
+
+	grading := tinykaboom.NewGrading()
+	grading.AutoExposure = *autoExpose
+	grading.RejectFireflies = *fireflies
+	grading.Denoise = *denoise
+	grading.RadialBlur = *radialBlur
+	grading.ToneMap = curve
+	grading.Contrast = *contrastK
+	grading.Curves = *rgbCurves
+	grading.Vignette = *vignetteK
+	grading.Grain = *grain
+	grading.ColorSpace = space
+	grading.ClampNegative = *clampNeg
+	grading.Debug = debug
+	// grade post-processes the frame number n of the image with the grading flags
+	grade := func(frame *tinykaboom.Frame, n int) {
+		g := grading
+		g.GrainSeed = uint64(n)<<32 ^ math.Float64bits(*seed)
+		g.Apply(frame)
+	}
+
+	if *dryRun {
+		if err := cfg.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		output := imagePath
+		if *frames > 0 {
+			output = fmt.Sprintf("frames %d to %d of %d at %g fps named %s", first, end-1, *frames, cfg.FPS, *frameNames)
+		}
+		describe(os.Stderr, &cfg, output)
+		return
+	}
+	if *palPreview != "" {
+		strip := tinykaboom.PaletteStrip(&cfg.Scene, cfg.Width, 32)
+		grade(strip, 0)
+		if err := writeImage(*palPreview, formats["png"], strip); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if need := estimateMemory(&cfg, out); *maxMemory > 0 && need > float64(*maxMemory) {
+		log.Fatalf("the render needs about %s of memory, more than the -max-memory limit of %v", format_bytes(need), maxMemory)
+	}
+
+	// output post-processes the frame number n and writes it to path, and its sidecar rendered describes with
+	// -write-metadata, cfg unless -repl changed it
+	rendered := &cfg
+	output := func(frame *tinykaboom.Frame, n int, path string) error {
+		if *stats {
+			fmt.Fprintf(os.Stderr, "%s: antialiased pixels: %d of %d, exposure %.3g\n", path, frame.Stats.Refined, frame.Width*frame.Height, frame.Stats.Exposure())
+		}
+		grade(frame, n)
+
+		enc := out
+		if *bitDepth == "auto" && tinykaboom.BandsAt8Bits(frame) { // decided for every frame of an animation
+			enc.write, enc.quantized = tinykaboom.WritePPM16, false
+		}
+		if mask != nil && enc.quantized {
+			tinykaboom.Dither(frame, mask)
+		}
+
+		if *flipH || *flipV {
+			tinykaboom.Flip(frame, *flipH, *flipV)
+		}
+		if *cropFit {
+			cropped, ok := tinykaboom.CropToContent(frame)
+			if !ok {
+				return fmt.Errorf("%s: nothing to crop to, all the rays missed", path)
+			}
+			frame = cropped
+		}
+
+		if *depthOut != "" {
+			if err := writeDepth(*depthOut, frame); err != nil {
+				return err
+			}
+		}
+		if err := writeImage(path, enc, frame); err != nil || !*writeMeta {
+			return err
+		}
+		return writeMetadata(path, rendered, n)
+	}
+
+	if *cpuprofile != "" {
+		f, err := os.Create(*cpuprofile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// the first interrupt stops the render and the partial image is written out, the second one quits right away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 2)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		log.Print("interrupted, writing the partial image; interrupt again to quit now")
+		cancel()
+		<-interrupt
+		pprof.StopCPUProfile() // os.Exit skips the one at the end, the profile would be cut short
+		os.Exit(1)
+	}()
+
+	if *seedSearch > 0 {
+		best, err := tinykaboom.SearchSeed(ctx, cfg, *seedSearch)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "seed %g\n", best)
+		cfg.Scene.Seed = best
+	}
+
+	stopProgress := func() {}
+	if *showProg {
+		cfg.Progress = &tinykaboom.Progress{}
+		stopProgress = cfg.Progress.Report(os.Stderr, 250*time.Millisecond)
+	}
+
+	var err error
+	if *benchRuns > 0 {
+		err = benchmark(ctx, cfg, *benchRuns)
+	} else if *replMode {
+		err = repl(cfg, os.Stdin, os.Stderr, func(cfg tinykaboom.RenderConfig) error {
+			rendered = &cfg
+			frame, err := tinykaboom.RenderContext(ctx, cfg)
+			if frame != nil {
+				if werr := output(frame, 0, imagePath); werr != nil {
+					return werr
+				}
+			}
+			return err
+		})
+	} else if *frames > 0 {
+		err = tinykaboom.WriteSequence(ctx, cfg, first, end, *encoders, func(frame *tinykaboom.Frame, n int) error {
+			return output(frame, n, fmt.Sprintf(*frameNames, n))
+		})
+	} else if *montage != "" {
+		var cols, rows int
+		if _, err := fmt.Sscanf(*montage, "%d,%d", &cols, &rows); err != nil {
+			log.Fatalf("invalid -seed-montage %q, want cols,rows", *montage)
+		}
+		var frame *tinykaboom.Frame
+		frame, err = tinykaboom.RenderSeedMontage(ctx, cfg, cols, rows)
+		stopProgress()
+		if frame != nil {
+			if werr := output(frame, 0, imagePath); werr != nil {
+				err = werr
+			}
+		}
+	} else if *progRender {
+		// each pass overwrites the image, so a viewer reloading it shows the render converging
+		_, err = tinykaboom.RenderProgressiveContext(ctx, cfg, func(pass int, frame *tinykaboom.Frame) error {
+			fmt.Fprintf(os.Stderr, "pass %d of %d\n", pass, cfg.AASamples*cfg.AASamples)
+			return output(frame.Clone(), 0, imagePath)
+		})
+	} else {
+		var frame *tinykaboom.Frame
+		frame, err = tinykaboom.RenderContext(ctx, cfg)
+		stopProgress()
+		if frame != nil {
+			var werr error
+			if *bracket {
+				werr = writeBracket(frame, imagePath, output)
+			} else {
+				werr = output(frame, 0, imagePath)
+			}
+			if werr != nil {
+				err = werr
+			}
+		}
+		if cp := cfg.Checkpoint; cp != nil {
+			switch {
+			case err == nil:
+				os.Remove(cp.Path) // done with it, even if a save failed along the way
+			case ctx.Err() != nil && cp.Err() == nil:
+				log.Printf("the rendered tiles are saved in %s, run again with -resume to finish the image", cp.Path)
+			}
+		}
+		if *traceAt != "" {
+			tinykaboom.TracePixel(os.Stderr, &cfg, traceX, traceY)
+		}
+		if err == nil && *reference != "" {
+			err = compareTo(*reference, frame)
+		}
+	}
+
+	if *cpuprofile != "" {
+		pprof.StopCPUProfile()
+	}
+	if *memprofile != "" {
+		err = errors.Join(err, writeMemProfile(*memprofile))
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeMemProfile writes a heap profile of the statistics of the garbage collection run now to path.
+func writeMemProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	runtime.GC() // get up-to-date statistics
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeBracket passes write copies of the frame exposed -2, 0 and +2 stops, to be post-processed and written to
+// path with _-2, _0 and _+2 inserted before its extension. The frame itself is left as it is.
+func writeBracket(frame *tinykaboom.Frame, path string, write func(frame *tinykaboom.Frame, n int, path string) error) error {
+	ext := filepath.Ext(path)
+	for _, stops := range []string{"-2", "0", "+2"} {
+		ev, _ := strconv.ParseFloat(stops, 64)
+		exposed := frame.Clone()
+		for i, c := range exposed.Color {
+			exposed.Color[i] = c.Mul(math.Exp2(ev))
+		}
+		if err := write(exposed, 0, strings.TrimSuffix(path, ext)+"_"+stops+ext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDepth writes the depth of the frame to path as a PGM, like writeImage does the colors.
+func writeDepth(path string, frame *tinykaboom.Frame) error {
+	pgm := outputFormat{write: func(w io.Writer, _ []*tinykaboom.Vec, _, _ int) error { return tinykaboom.WriteDepthPGM(w, frame) }}
+	return writeImage(path, pgm, frame)
+}
+
+// writeImage encodes the frame in the format out to the file path, or to the standard output if path is -. The
+// errors wrap the ones of the os package.
+func writeImage(path string, out outputFormat, frame *tinykaboom.Frame) error {
+	if path == "-" {
+		if err := out.write(os.Stdout, frame.Color, frame.Width, frame.Height); err != nil {
+			return fmt.Errorf("writing to the standard output: %w", err)
+		}
+		return nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := out.write(f, frame.Color, frame.Width, frame.Height); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil { // the data may only reach the disk now, a full disk shows up here
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
+
+// benchmark renders cfg n times and prints the minimum, median, 95th percentile and maximum render times.
+func benchmark(ctx context.Context, cfg tinykaboom.RenderConfig, n int) error {
+	var times []time.Duration
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before) // outside of the timings, it stops the world
+	for len(times) < n {
+		start := time.Now()
+		if _, err := tinykaboom.RenderContext(ctx, cfg); err != nil {
+			return err
+		}
+		times = append(times, time.Since(start))
+	}
+	runtime.ReadMemStats(&after)
+	slices.Sort(times)
+	percentile := func(p float64) time.Duration { return times[int(math.Ceil(p*float64(n)))-1] }
+	pixels := float64(cfg.Width) * float64(cfg.Height)
+	fmt.Fprintf(os.Stderr, "%d renders of %dx%d: min %v, median %v, p95 %v, max %v, %.3g pixels/s at the median, %.4g allocations per pixel\n",
+		n, cfg.Width, cfg.Height, times[0].Round(time.Millisecond), percentile(0.5).Round(time.Millisecond),
+		percentile(0.95).Round(time.Millisecond), times[n-1].Round(time.Millisecond), pixels/percentile(0.5).Seconds(),
+		float64(after.Mallocs-before.Mallocs)/float64(n)/pixels)
+	return nil
+}
+
+// estimateMemory estimates the peak memory of the render, the post-processing and the encoding of an image
+// for -max-memory.
+func estimateMemory(cfg *tinykaboom.RenderConfig, out outputFormat) float64 {
+	width, height := float64(cfg.Width), float64(cfg.Height)
+	if cfg.Stereo == tinykaboom.StereoSideBySide {
+		width *= 2
+	}
+	pixels := width * height
+	need := tinykaboom.RenderMemory(cfg)
+	switch {
+	case *frames > 0:
+		need += float64(cfg.Width) * float64(cfg.Height) * (8 + 24)      // the ray grid shared by the frames
+		need += float64(*encoders) * pixels * tinykaboom.FramePixelBytes // the frames being written
+	case *progRender:
+		need += pixels * ((8 + 24) + tinykaboom.FramePixelBytes) // the sums of the samples and the copy being written
+	}
+	if *fireflies || *denoise > 0 || *radialBlur > 0 {
+		need += pixels * 8 // the filters write into a new slice of colors
+	}
+	if *cropFit {
+		need += pixels * tinykaboom.FramePixelBytes
+	}
+	if *bracket {
+		need += pixels * tinykaboom.FramePixelBytes // the exposed copy
+	}
+	if *reference != "" {
+		need += pixels * 3
+	}
+	return need + pixels*float64(out.buffered)
+}
+
+// compareTo compares the frame to the reference PPM file for -compare, failing if too many pixels differ.
+func compareTo(name string, frame *tinykaboom.Frame) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+	defer f.Close()
+	ref, width, height, err := tinykaboom.ReadPPM(f)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+	if width != frame.Width || height != frame.Height {
+		return fmt.Errorf("%s is %dx%d, the image is %dx%d", name, width, height, frame.Width, frame.Height)
+	}
+	c := tinykaboom.CompareToReference(frame.Color, ref, *tolerance)
+	fraction := float64(c.Mismatched) / float64(c.Pixels)
+	fmt.Fprintf(os.Stderr, "%s: %d of %d pixels (%.2f%%) off by more than %d, largest difference %d, mean %.3f\n",
+		name, c.Mismatched, c.Pixels, 100*fraction, *tolerance, c.MaxDiff, c.MeanDiff)
+	if fraction > *mismatches {
+		return fmt.Errorf("the image differs from %s in %.2f%% of the pixels, more than the %.2f%% allowed", name, 100*fraction, 100**mismatches)
+	}
+	return nil
+}
+
+func loadImage(name string) (image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+	return img, nil
+}
+
+// describe prints a summary of the render cfg writing to output for -dry-run.
+func describe(w io.Writer, cfg *tinykaboom.RenderConfig, output string) {
+	const deg = 180 / math.Pi
+	s := &cfg.Scene
+	fmt.Fprintf(w, "output:      %s (%s)\n", output, *format)
+	fmt.Fprintf(w, "resolution:  %dx%d, %d workers on %dx%d tiles\n", cfg.Width, cfg.Height, tinykaboom.NumWorkers(cfg), cfg.TileSize, cfg.TileSize)
+	fmt.Fprintf(w, "camera:      at %v, %s, field of view %.4g°", s.Camera, *projection, cfg.FOV*deg)
+	if cfg.Projection == tinykaboom.ProjectionCylindrical {
+		fmt.Fprintf(w, " by %.4g° horizontally", cfg.HFOV*deg)
+	}
+	fmt.Fprintf(w, ", zoom %g, roll %.4g°", cfg.Zoom, s.Roll*deg)
+	if par := cfg.PixelAspect; par != 0 && par != 1 {
+		fmt.Fprintf(w, ", pixel aspect %g", par)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "explosion:   %s of radius %g at %v, time %gs\n", *sdfName, tinykaboom.SceneRadius(s), s.Center, s.Time)
+	fmt.Fprintf(w, "memory:      about %s, limit %v\n", format_bytes(estimateMemory(cfg, formats[*format])), maxMemory)
+	fmt.Fprintf(w, "noise:       %s %dD, seed %g, evolving %g per second, period %d\n", *noiseKind, s.NoiseDims, s.Seed, s.Evolve, s.NoisePeriod)
+	fmt.Fprintf(w, "             frequency %g, amplitude %g\n", s.NoiseFreq, s.NoiseAmp)
+	fmt.Fprintf(w, "             rotation rows %v %v %v\n", s.NoiseRotation[0], s.NoiseRotation[1], s.NoiseRotation[2])
+	fmt.Fprintf(w, "palette:     %s, smooth %t, gamma %g, inverted %t, cycling %g times per second\n", *palName, s.SmoothPalette, s.PaletteGamma, s.InvertPalette, s.PaletteCycle)
+	fmt.Fprintf(w, "lights:      point lights at %v, ambient %g, shadow sharpness %g, normals %g of the way to the shape's\n", s.Lights, s.Ambient, s.Shadow, s.SmoothNormal)
+	if s.LightSize > 0 {
+		fmt.Fprintf(w, "             lights of radius %g, %d shadow rays each (0 for 16)\n", s.LightSize, s.LightSamples)
+	}
+	for _, l := range s.SpotLights {
+		fmt.Fprintf(w, "             spotlight at %v towards %v, cone %.4g°, falloff %.4g°\n", l.Position, l.Direction, l.Angle*deg, l.Falloff*deg)
+	}
+	if fl := s.Floor; fl != nil {
+		fmt.Fprintf(w, "floor:       checker at y=%g, %v and %v squares of %g\n", fl.Height, fl.Colors[0], fl.Colors[1], fl.Tile)
+	}
+	fmt.Fprintf(w, "background:  %s", *bg)
+	if *bgImage != "" {
+		fmt.Fprintf(w, " behind %s", *bgImage)
+	}
+	if *compOver != "" {
+		fmt.Fprintf(w, ", composited over %s", *compOver)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "antialias:   %s, %dx%d samples, threshold %g, cheap %t, supersampling %dx\n", *aaMode, cfg.AASamples, cfg.AASamples, cfg.AAThreshold, cfg.CheapAA, cfg.SSAA)
+	fmt.Fprintf(w, "motion blur: %d samples over %.4gs\n", cfg.MotionBlur, cfg.Shutter)
+	if cfg.Stereo != tinykaboom.StereoNone {
+		fmt.Fprintf(w, "stereo:      eyes %g apart, anaglyph %t\n", cfg.IPD, cfg.Stereo == tinykaboom.StereoAnaglyph)
+	}
+	if cfg.Debug != tinykaboom.DebugNone {
+		fmt.Fprintf(w, "debug:       %s\n", *debugMode)
+	}
+}
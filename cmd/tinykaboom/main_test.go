@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/holygeek/tinykaboom"
+)
+
+// TestMain runs main with the arguments in TK_TEST_MAIN_ARGS instead of the tests when it is set, for the tests
+// of the exit status.
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("TK_TEST_MAIN_ARGS"); ok {
+		os.Args = append([]string{os.Args[0]}, strings.Fields(args)...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testFrame returns a small render of the default scene.
+func testFrame() *tinykaboom.Frame {
+	cfg := tinykaboom.RenderConfig{Width: 8, Height: 6, FOV: 1, Scene: tinykaboom.NewScene()}
+	f, err := tinykaboom.RenderFrame(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// TestWriteFullDisk checks that the error of a write failing on a full disk gets out of writeImage, and that
+// main then exits with a failure status.
+func TestWriteFullDisk(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to fill")
+	}
+	for name, out := range formats {
+		if err := writeImage("/dev/full", out, testFrame()); !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("writing %s to /dev/full returned %v, want %v", name, err, syscall.ENOSPC)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "TK_TEST_MAIN_ARGS=-width 8 -height 6 -out /dev/full")
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.Success() {
+		t.Errorf("main writing to /dev/full exited with %v, want a failure; output:\n%s", err, out)
+	}
+}
+
+// TestWriteImageError checks that the error of writeImage names the file and unwraps to the one of the os.
+func TestWriteImageError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "out.ppm")
+	err := writeImage(path, formats["ppm"], testFrame())
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("writeImage(%s) returned %v, want an error unwrapping to %v", path, err, fs.ErrNotExist)
+	}
+	var perr *fs.PathError
+	if !errors.As(err, &perr) || perr.Path != path {
+		t.Errorf("writeImage(%s) returned %v, want a *fs.PathError for the path", path, err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "writing "+path) {
+		t.Errorf("the error %q doesn't say which file failed", err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// available_memory returns the memory available for starting new processes according to /proc/meminfo, 0
+// when it isn't known.
+func available_memory() int64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 3 && fields[0] == "MemAvailable:" && fields[2] == "kB" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb << 10
+		}
+	}
+	return 0
+}
+
+// format_bytes formats a memory size with a binary unit, like 1.5G.
+func format_bytes(b float64) string {
+	unit := ""
+	for k := 0; b >= 1024 && k < len(byteUnits); k++ {
+		b /= 1024
+		unit = byteUnits[k : k+1]
+	}
+	return fmt.Sprintf("%.3g%s", b, unit)
+}
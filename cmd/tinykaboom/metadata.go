@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+
+	"github.com/holygeek/tinykaboom"
+)
+
+// version identifies the build in the -write-metadata sidecars, set by the releases with
+// -ldflags "-X main.version=v1.2.3".
+var version = "devel"
+
+// buildVersion is version followed by the VCS revision the go command stamped into the binary, when it did.
+func buildVersion() string {
+	v := version
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				v += " " + s.Value
+			}
+		}
+	}
+	return v
+}
+
+// renderMetadata is the -write-metadata sidecar of an image: the resolved parameters of its render, for the
+// asset libraries, and the value of every flag, enough to render it again.
+type renderMetadata struct {
+	Version    string            `json:"version"`
+	Image      string            `json:"image"`
+	Frame      *int              `json:"frame,omitempty"` // number in the animation, none for a single image
+	Time       float64           `json:"time"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	Projection string            `json:"projection"`
+	FOV        float64           `json:"fov_degrees"`
+	Zoom       float64           `json:"zoom"`
+	Camera     *tinykaboom.Vec   `json:"camera"`
+	Lights     []*tinykaboom.Vec `json:"lights"`
+	Roll       float64           `json:"roll_degrees"`
+	Shape      string            `json:"shape"`
+	Radius     float64           `json:"radius"`
+	Center     *tinykaboom.Vec   `json:"center"`
+	Noise      noiseMetadata     `json:"noise"`
+	Palette    paletteMetadata   `json:"palette"`
+	Ambient    float64           `json:"ambient"`
+	Shadow     float64           `json:"shadow"`
+	LightSize  float64           `json:"light_size"`
+	LightRays  int               `json:"light_samples"`
+	Flags      map[string]string `json:"flags"`
+}
+
+type noiseMetadata struct {
+	Kind      string  `json:"kind"`
+	Seed      float64 `json:"seed"`
+	Evolve    float64 `json:"evolve"`
+	Dims      int     `json:"dims"`
+	Period    int     `json:"period"`
+	Frequency float64 `json:"frequency"`
+	Amplitude float64 `json:"amplitude"`
+}
+
+type paletteMetadata struct {
+	Name     string  `json:"name"`
+	Smooth   bool    `json:"smooth"`
+	Inverted bool    `json:"inverted"`
+	Gamma    float64 `json:"gamma"`
+	Cycle    float64 `json:"cycle"`
+	Bands    int     `json:"bands"`
+}
+
+// writeMetadata writes the sidecar of the image written to path, path with its extension replaced by .json. The
+// image is the frame number n of the animation of cfg with -frames, the image of cfg otherwise.
+func writeMetadata(path string, cfg *tinykaboom.RenderConfig, n int) error {
+	const deg = 180 / math.Pi
+	s := &cfg.Scene
+	freq, amp := tinykaboom.NoiseScale(s)
+	m := renderMetadata{
+		Version:    buildVersion(),
+		Image:      path,
+		Time:       s.Time,
+		Width:      cfg.Width,
+		Height:     cfg.Height,
+		Projection: *projection,
+		FOV:        cfg.FOV * deg,
+		Zoom:       cfg.Zoom,
+		Camera:     s.Camera,
+		Lights:     s.Lights,
+		Roll:       s.Roll * deg,
+		Shape:      *sdfName,
+		Radius:     tinykaboom.SceneRadius(s),
+		Center:     s.Center,
+		Noise:      noiseMetadata{*noiseKind, s.Seed, s.Evolve, s.NoiseDims, s.NoisePeriod, freq, amp},
+		Palette:    paletteMetadata{*palName, s.SmoothPalette, s.InvertPalette, s.PaletteGamma, s.PaletteCycle, s.PaletteBands},
+		Ambient:    s.Ambient,
+		Shadow:     s.Shadow,
+		LightSize:  s.LightSize,
+		LightRays:  s.LightSamples,
+		Flags:      map[string]string{},
+	}
+	if *frames > 0 {
+		m.Frame, m.Time = &n, tinykaboom.FrameTime(cfg, n)
+	}
+	flag.VisitAll(func(f *flag.Flag) { m.Flags[f.Name] = f.Value.String() })
+
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(path, filepath.Ext(path)) + ".json"
+	if err := os.WriteFile(name, append(data, '\n'), 0o666); err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/holygeek/tinykaboom"
+)
+
+// replSetting is a parameter of the render the -repl commands read and change.
+type replSetting struct {
+	get func(cfg *tinykaboom.RenderConfig) float64
+	set func(cfg *tinykaboom.RenderConfig, v float64)
+}
+
+var replSettings = map[string]replSetting{
+	"seed":            {func(c *tinykaboom.RenderConfig) float64 { return c.Scene.Seed }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.Seed = v }},
+	"time":            {func(c *tinykaboom.RenderConfig) float64 { return c.Scene.Time }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.Time = v }},
+	"evolve":          {func(c *tinykaboom.RenderConfig) float64 { return c.Scene.Evolve }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.Evolve = v }},
+	"noise-frequency": {func(c *tinykaboom.RenderConfig) float64 { freq, _ := tinykaboom.NoiseScale(&c.Scene); return freq }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.NoiseFreq = v }},
+	"amplitude":       {func(c *tinykaboom.RenderConfig) float64 { _, amp := tinykaboom.NoiseScale(&c.Scene); return amp }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.NoiseAmp = v }},
+	"radius":          {func(c *tinykaboom.RenderConfig) float64 { return tinykaboom.SceneRadius(&c.Scene) }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.Radius = v }},
+	"ambient":         {func(c *tinykaboom.RenderConfig) float64 { return c.Scene.Ambient }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.Ambient = v }},
+	"shadow":          {func(c *tinykaboom.RenderConfig) float64 { return c.Scene.Shadow }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.Shadow = v }},
+	"light-size":      {func(c *tinykaboom.RenderConfig) float64 { return c.Scene.LightSize }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.LightSize = v }},
+	"light-samples":   {func(c *tinykaboom.RenderConfig) float64 { return float64(c.Scene.LightSamples) }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.LightSamples = int(v) }},
+	"palette-gamma":   {func(c *tinykaboom.RenderConfig) float64 { return c.Scene.PaletteGamma }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.PaletteGamma = v }},
+	"palette-cycle":   {func(c *tinykaboom.RenderConfig) float64 { return c.Scene.PaletteCycle }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.PaletteCycle = v }},
+	"light-orbit":     {func(c *tinykaboom.RenderConfig) float64 { return c.Scene.LightOrbit }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.LightOrbit = v }},
+	"normal-mode":     {func(c *tinykaboom.RenderConfig) float64 { return c.Scene.SmoothNormal }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.SmoothNormal = v }},
+	"roll":            {func(c *tinykaboom.RenderConfig) float64 { return c.Scene.Roll * 180 / math.Pi }, func(c *tinykaboom.RenderConfig, v float64) { c.Scene.Roll = v * math.Pi / 180 }},
+	"zoom":            {func(c *tinykaboom.RenderConfig) float64 { return c.Zoom }, func(c *tinykaboom.RenderConfig, v float64) { c.Zoom = v }},
+}
+
+// repl calls render with cfg, then reads commands from in, one per line, changing a copy of cfg and calling
+// render with it again: a setting name followed by its new value, like seed 5, show to print the settings,
+// render, help and quit. The settings have the units of the flags of the same names. A value making cfg invalid
+// is refused and the previous one kept.
+func repl(cfg tinykaboom.RenderConfig, in io.Reader, out io.Writer, render func(cfg tinykaboom.RenderConfig) error) error {
+	names := make([]string, 0, len(replSettings))
+	for name := range replSettings {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if err := render(cfg); err != nil {
+		return err
+	}
+
+	lines := bufio.NewScanner(in)
+	for fmt.Fprint(out, "> "); lines.Scan(); fmt.Fprint(out, "> ") {
+		fields := strings.Fields(lines.Text())
+		switch {
+		case len(fields) == 0:
+		case len(fields) == 1 && fields[0] == "render":
+			if err := render(cfg); err != nil {
+				return err
+			}
+		case len(fields) == 1 && (fields[0] == "quit" || fields[0] == "exit"):
+			return nil
+		case len(fields) == 1 && fields[0] == "help":
+			fmt.Fprintf(out, "render, show, quit, or a setting followed by its value: %s\n", strings.Join(names, ", "))
+		case len(fields) == 1 && fields[0] == "show":
+			for _, name := range names {
+				fmt.Fprintf(out, "%s %g\n", name, replSettings[name].get(&cfg))
+			}
+		case len(fields) == 2 && replSettings[fields[0]].set != nil:
+			v, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				fmt.Fprintf(out, "invalid %s %q\n", fields[0], fields[1])
+				continue
+			}
+			next := cfg
+			replSettings[fields[0]].set(&next, v)
+			if err := next.Validate(); err != nil {
+				fmt.Fprintln(out, err)
+				continue
+			}
+			cfg = next
+		default:
+			fmt.Fprintf(out, "unknown command %q, try help\n", lines.Text())
+		}
+	}
+	return lines.Err()
+}
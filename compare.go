@@ -0,0 +1,67 @@
+package tinykaboom
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ReadPPM decodes a binary 8-bit P6 PPM, the format WritePPM and the C++ tinykaboom write.
+func ReadPPM(r io.Reader) (pix []byte, width, height int, err error) {
+	b := bufio.NewReader(r)
+	var magic string
+	var maxval int
+	if _, err := fmt.Fscan(b, &magic, &width, &height, &maxval); err != nil {
+		return nil, 0, 0, fmt.Errorf("bad PPM header: %w", err)
+	}
+	if magic != "P6" || maxval != 255 || width <= 0 || height <= 0 {
+		return nil, 0, 0, fmt.Errorf("unsupported PPM %s %dx%d with maximum value %d, only 8-bit P6 is", magic, width, height, maxval)
+	}
+	if _, err := b.ReadByte(); err != nil { // the single whitespace ending the header
+		return nil, 0, 0, err
+	}
+	pix = make([]byte, 3*width*height)
+	if _, err := io.ReadFull(b, pix); err != nil {
+		return nil, 0, 0, fmt.Errorf("truncated PPM: %w", err)
+	}
+	return pix, width, height, nil
+}
+
+// Comparison sums up how much an image differs from a reference.
+type Comparison struct {
+	Pixels     int     // pixels compared
+	Mismatched int     // pixels with a channel off by more than the tolerance
+	MaxDiff    int     // largest channel difference
+	MeanDiff   float64 // mean absolute channel difference
+}
+
+// CompareToReference quantizes the framebuffer like WritePPM and compares it channel by channel to the 8-bit
+// reference pixels. The port can't match the C++ byte for byte: the C++ marches in float and the chaotic noise
+// amplifies the rounding differences, so a few pixels around the silhouette and the holes always come out different.
+func CompareToReference(framebuffer []*Vec, ref []byte, tolerance int) Comparison {
+	c := Comparison{Pixels: len(ref) / 3}
+	sum := 0
+	for i := 0; i < c.Pixels; i++ {
+		v := framebuffer[i]
+		mismatch := false
+		for k, x := range [3]float64{v.x, v.y, v.z} {
+			d := int(byte(math.Max(0, math.Min(255, 255*x)))) - int(ref[3*i+k])
+			if d < 0 {
+				d = -d
+			}
+			sum += d
+			if d > c.MaxDiff {
+				c.MaxDiff = d
+			}
+			if d > tolerance {
+				mismatch = true
+			}
+		}
+		if mismatch {
+			c.Mismatched++
+		}
+	}
+	c.MeanDiff = float64(sum) / float64(3*c.Pixels)
+	return c
+}
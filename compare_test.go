@@ -0,0 +1,37 @@
+package tinykaboom
+
+import (
+	"math"
+	"os"
+	"testing"
+)
+
+// TestGolden compares the default render to the image of the C++ original, with the -compare defaults.
+func TestGolden(t *testing.T) {
+	if testing.Short() {
+		t.Skip("renders the full 640x480 image")
+	}
+	file, err := os.Open("testdata/tinykaboom-cpp.ppm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	ref, width, height, err := ReadPPM(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := RenderConfig{Width: 640, Height: 480, FOV: math.Pi / 3, Scene: NewScene()}
+	if width != cfg.Width || height != cfg.Height {
+		t.Fatalf("the reference is %dx%d, want %dx%d", width, height, cfg.Width, cfg.Height)
+	}
+	fb, err := Render(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const tolerance, maxMismatch = 16, 0.02
+	c := CompareToReference(fb, ref, tolerance)
+	if fraction := float64(c.Mismatched) / float64(c.Pixels); fraction > maxMismatch {
+		t.Errorf("%d of the %d pixels (%.2f%%) differ from the C++ image by more than %d, max %d, mean %.3f",
+			c.Mismatched, c.Pixels, 100*fraction, tolerance, c.MaxDiff, c.MeanDiff)
+	}
+}
@@ -0,0 +1,96 @@
+package tinykaboom
+
+import (
+	"fmt"
+	"io"
+)
+
+// DebugMode selects a diagnostic visualization instead of the regular shading.
+type DebugMode int
+
+const (
+	DebugNone  DebugMode = iota
+	DebugSteps           // the pixels are colored by the number of ray march iterations they took
+	DebugClip            // the pixels of the graded image out of [0,1] are highlighted, see debug_clip
+)
+
+// DebugModes maps the -debug names to the visualizations.
+var DebugModes = map[string]DebugMode{
+	"none":  DebugNone,
+	"steps": DebugSteps,
+	"clip":  DebugClip,
+}
+
+// debug_steps_hit maps the iterations of a ray reaching the surface to a heatmap going blue, cyan, green, yellow, red.
+func debug_steps_hit(steps int) *Vec {
+	stops := []*Vec{NewVec(0, 0, 1), NewVec(0, 1, 1), NewVec(0, 1, 0), NewVec(1, 1, 0), NewVec(1, 0, 0)}
+	t := float64(steps) / max_march_steps * float64(len(stops)-1)
+	k := int(t)
+	if k >= len(stops)-1 {
+		return stops[len(stops)-1]
+	}
+	return lerpVec(stops[k], stops[k+1], t-float64(k))
+}
+
+// debug_clip replaces the colors of the frame by where they clip: red for the pixels with a channel above 1, blue
+// for those with a negative channel and magenta for both. The others are turned to a dim gray of their
+// luminance to show where the clipped pixels are in the image.
+func debug_clip(f *Frame) {
+	for i, c := range f.Color {
+		over := c.x > 1 || c.y > 1 || c.z > 1
+		under := c.x < 0 || c.y < 0 || c.z < 0
+		switch {
+		case over && under:
+			f.Color[i] = NewVec(1, 0, 1)
+		case over:
+			f.Color[i] = NewVec(1, 0, 0)
+		case under:
+			f.Color[i] = NewVec(0, 0, 1)
+		default:
+			l := 0.5 * c.Luminance()
+			f.Color[i] = NewVec(l, l, l)
+		}
+	}
+}
+
+// TracePixel writes to w how the ray through the center of the pixel in the column i and the row j from the top
+// of the image is shaded: the ray, where the march stops, the noise and the normal there, and the resulting color.
+// It retraces the pixel with the functions of the render instead of instrumenting them, so the render doesn't
+// get any slower; the color is the one before the antialiasing and the post-processing.
+func TracePixel(w io.Writer, cfg *RenderConfig, i, j int) {
+	s := &cfg.Scene
+	x, y := float64(i)+0.5, float64(j)+0.5
+	orig, dir := camera_ray(cfg, x, y)
+	fmt.Fprintf(w, "pixel %d,%d: ray from %v towards %v\n", i, j, orig, dir)
+	if masked_out(cfg, x, y) {
+		fmt.Fprintln(w, "  masked out, background")
+	}
+
+	var hit Vec
+	ok, t, steps := sphere_trace_steps(orig, dir, &hit, s)
+	switch {
+	case ok:
+		p := hit.Sub(s.Center)
+		noise := noise_displacement(p, s)
+		fmt.Fprintf(w, "  hit after %d steps at distance %g, position %v\n", steps, t, &hit)
+		fmt.Fprintf(w, "  shape distance %g, noise displacement %g, signed distance %g\n", shape(s)(p), noise, signed_distance(&hit, s))
+		_, amplitude := NoiseScale(s)
+		fmt.Fprintf(w, "  noise level %g, palette position %g, palette color %v\n", -shape(s)(p)/amplitude, (-.2-shape(s)(p)/amplitude)*2, surface_color(cfg, &hit))
+		n := surface_normal(&hit, s)
+		fmt.Fprintf(w, "  normal %v, lighting %g\n", n, illumination(cfg, &hit, n))
+		for _, l := range s.Lights {
+			fmt.Fprintf(w, "  light direction %v\n", light_position(s, l).Sub(&hit).Normalize(1))
+		}
+	case steps == 0:
+		fmt.Fprintln(w, "  missed the bounding sphere, not marched")
+	default:
+		fmt.Fprintf(w, "  missed after %d steps, %g marched\n", steps, t)
+	}
+	if fl := s.Floor; fl != nil {
+		if ft, fok := fl.intersect(orig, dir); fok {
+			fmt.Fprintf(w, "  floor at distance %g, in front of the explosion %t\n", ft, !ok || ft < t)
+		}
+	}
+	c, d := renderSample(cfg, x, y)
+	fmt.Fprintf(w, "  color %v, depth %g\n", c, d)
+}
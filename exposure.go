@@ -0,0 +1,54 @@
+package tinykaboom
+
+import "math"
+
+const (
+	histogram_bins    = 128
+	histogram_min_ev  = -12.0 // log2 luminance of the lowest bin, the darker pixels all go there
+	histogram_max_ev  = 4.0   // log2 luminance past the highest bin, the brighter pixels all go there
+	auto_exposure_key = 0.5   // luminance the auto exposure brings the average of the image to
+)
+
+// histogram counts the pixels by log2 luminance.
+type histogram [histogram_bins]int
+
+func (h *histogram) add(c *Vec) {
+	ev := math.Log2(math.Max(c.Luminance(), 1e-9))
+	b := int((ev - histogram_min_ev) / (histogram_max_ev - histogram_min_ev) * histogram_bins)
+	h[max(0, min(histogram_bins-1, b))]++
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i := range h {
+		h[i] += o[i]
+	}
+}
+
+// exposure returns the factor bringing the geometric mean luminance of the pixels to auto_exposure_key. The
+// darkest and brightest 5% of the pixels are left out so a few black holes or hot spots don't swing it.
+func (h *histogram) exposure() float64 {
+	total := 0
+	for _, n := range h {
+		total += n
+	}
+	if total == 0 {
+		return 1
+	}
+	lo, hi := total/20, total-total/20
+	sum, count, seen := 0.0, 0, 0
+	for i, n := range h {
+		// the part of the bin inside [lo,hi) of the pixels sorted by luminance
+		k := min(seen+n, hi) - max(seen, lo)
+		seen += n
+		if k <= 0 {
+			continue
+		}
+		ev := histogram_min_ev + (float64(i)+0.5)/histogram_bins*(histogram_max_ev-histogram_min_ev)
+		sum += float64(k) * ev
+		count += k
+	}
+	if count == 0 {
+		return 1
+	}
+	return auto_exposure_key / math.Exp2(sum/float64(count))
+}
@@ -0,0 +1,92 @@
+package tinykaboom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// WriteEXR encodes the framebuffer as an uncompressed scanline OpenEXR image with 32-bit float R, G and B channels.
+// Unlike the 8-bit formats the values are written as they are, the "hot" palette colors above 1 included.
+func WriteEXR(w io.Writer, framebuffer []*Vec, width, height int) error {
+	b := &bytes.Buffer{}
+	le := binary.LittleEndian
+	u32 := func(v uint32) {
+		var buf [4]byte
+		le.PutUint32(buf[:], v)
+		b.Write(buf[:])
+	}
+	attr := func(name, typ string, size int) {
+		b.WriteString(name)
+		b.WriteByte(0)
+		b.WriteString(typ)
+		b.WriteByte(0)
+		u32(uint32(size))
+	}
+	box := func(name string) {
+		attr(name, "box2i", 16)
+		u32(0)
+		u32(0)
+		u32(uint32(width - 1))
+		u32(uint32(height - 1))
+	}
+
+	u32(20000630) // magic number
+	u32(2)        // version 2, single part scanline file
+
+	channels := "BGR" // the channel list must be sorted by name
+	attr("channels", "chlist", len(channels)*18+1)
+	for _, c := range channels {
+		b.WriteByte(byte(c))
+		b.WriteByte(0)
+		u32(2) // pixel type FLOAT
+		u32(0) // pLinear and reserved bytes
+		u32(1) // x sampling
+		u32(1) // y sampling
+	}
+	b.WriteByte(0)
+	attr("compression", "compression", 1)
+	b.WriteByte(0) // NO_COMPRESSION
+	box("dataWindow")
+	box("displayWindow")
+	attr("lineOrder", "lineOrder", 1)
+	b.WriteByte(0) // INCREASING_Y
+	attr("pixelAspectRatio", "float", 4)
+	u32(math.Float32bits(1))
+	attr("screenWindowCenter", "v2f", 8)
+	u32(math.Float32bits(0))
+	u32(math.Float32bits(0))
+	attr("screenWindowWidth", "float", 4)
+	u32(math.Float32bits(1))
+	b.WriteByte(0) // end of header
+
+	// the header size is known only now, the offset table follows it with one entry per scanline
+	header := uint64(b.Len())
+	lineSize := uint64(len(channels) * 4 * width)
+	for j := 0; j < height; j++ {
+		var buf [8]byte
+		le.PutUint64(buf[:], header+uint64(height)*8+uint64(j)*(8+lineSize))
+		b.Write(buf[:])
+	}
+
+	for j := 0; j < height; j++ {
+		u32(uint32(j))
+		u32(uint32(lineSize))
+		row := framebuffer[j*width : (j+1)*width]
+		for _, c := range channels {
+			for _, v := range row {
+				switch c {
+				case 'B':
+					u32(math.Float32bits(float32(v.z)))
+				case 'G':
+					u32(math.Float32bits(float32(v.y)))
+				case 'R':
+					u32(math.Float32bits(float32(v.x)))
+				}
+			}
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
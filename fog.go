@@ -0,0 +1,35 @@
+package tinykaboom
+
+import "math"
+
+// Fog is a haze thickening exponentially downwards, lying on the ground under the explosion.
+type Fog struct {
+	Density float64 // extinction per unit of distance at Height
+	Height  float64 // y coordinate where the density is Density, it is e times denser Falloff lower
+	Falloff float64 // height over which the density falls by a factor e
+	Color   *Vec    // color the rays fade to
+}
+
+// optical_depth integrates the density of the fog along the ray starting at orig in the unit direction dir over
+// the distance t, which may be infinite for the rays going to the sky.
+func (fg *Fog) optical_depth(orig, dir *Vec, t float64) float64 {
+	base := fg.Density * math.Exp(-(orig.y-fg.Height)/fg.Falloff)
+	k := dir.y / fg.Falloff
+	if math.Abs(k*t) < 1e-9 { // horizontal ray, the density is constant along it
+		return base * t
+	}
+	return base * -math.Expm1(-k*t) / k
+}
+
+// apply_fog fades the color c of the ray starting at orig in the direction dir towards the color of the fog of
+// the scene, by the transmittance of the fog over the distance d the ray travelled.
+func apply_fog(s *Scene, orig, dir, c *Vec, d float64) *Vec {
+	if s.Fog == nil {
+		return c
+	}
+	tr := math.Exp(-s.Fog.optical_depth(orig, dir, d))
+	if math.IsNaN(tr) { // an infinite ray going down, through all the fog
+		tr = 0
+	}
+	return c.Mul(tr).MulAdd(s.Fog.Color, 1-tr)
+}
@@ -0,0 +1,60 @@
+package tinykaboom
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FrameBuffers is a pair of framebuffers for live display: the frames are rendered into the back buffer while
+// the front one is displayed, then the buffers are swapped.
+//
+// Rendering into Back is safe while other goroutines read the front buffer through View. Swap waits for the
+// views in progress to end, so a view never sees a buffer that's being rendered into. Only one goroutine may
+// render into the back buffer and swap.
+type FrameBuffers struct {
+	Width, Height int
+
+	mu          sync.RWMutex // held for reading by the views, for writing by the swaps
+	front, back []*Vec
+}
+
+// NewFrameBuffers returns two width x height buffers, cleared to black.
+func NewFrameBuffers(width, height int) *FrameBuffers {
+	b := &FrameBuffers{Width: width, Height: height, front: make([]*Vec, width*height), back: make([]*Vec, width*height)}
+	for i := range b.front {
+		b.front[i], b.back[i] = NewVec(0, 0, 0), NewVec(0, 0, 0)
+	}
+	return b
+}
+
+// Back returns the buffer to render the next frame into.
+func (b *FrameBuffers) Back() []*Vec {
+	return b.back
+}
+
+// View calls fn with the front buffer, which doesn't change until fn returns. fn mustn't keep the buffer.
+func (b *FrameBuffers) View(fn func(front []*Vec)) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	fn(b.front)
+}
+
+// Swap makes the back buffer the front one and the other way around.
+func (b *FrameBuffers) Swap() {
+	b.mu.Lock()
+	b.front, b.back = b.back, b.front
+	b.mu.Unlock()
+}
+
+// RenderInto renders the explosion into the framebuffer back, which must have the size of the rendered image.
+func RenderInto(back []*Vec, cfg RenderConfig) error {
+	f, err := RenderFrame(cfg)
+	if err != nil {
+		return err
+	}
+	if len(back) != len(f.Color) {
+		return fmt.Errorf("the framebuffer holds %d pixels, the %dx%d image has %d", len(back), f.Width, f.Height, len(f.Color))
+	}
+	copy(back, f.Color)
+	return nil
+}
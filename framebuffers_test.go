@@ -0,0 +1,64 @@
+package tinykaboom
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// TestFrameBuffers swaps rendered frames in while another goroutine reads the front buffer, for go test -race.
+// Every view must see a whole frame, the first black one or one of those rendered.
+func TestFrameBuffers(t *testing.T) {
+	cfg := RenderConfig{Width: 32, Height: 24, FOV: math.Pi / 3, Scene: NewScene(), Workers: 2}
+	b := NewFrameBuffers(cfg.Width, cfg.Height)
+	var frames [][]Vec // copies of the frames swapped in, the first being black
+	black := make([]Vec, cfg.Width*cfg.Height)
+	frames = append(frames, black)
+	var mu sync.Mutex // guards frames
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			var view []Vec
+			b.View(func(front []*Vec) {
+				for _, c := range front {
+					view = append(view, *c)
+				}
+			})
+			mu.Lock()
+			found := false
+			for _, f := range frames {
+				found = found || slices.Equal(view, f)
+			}
+			mu.Unlock()
+			if !found {
+				t.Error("a view saw a frame that was being rendered")
+				return
+			}
+		}
+	}()
+	for n := 0; n < 4; n++ {
+		cfg.Scene.Time = float64(n) / 10
+		if err := RenderInto(b.Back(), cfg); err != nil {
+			t.Fatal(err)
+		}
+		f := make([]Vec, len(b.Back()))
+		for k, c := range b.Back() {
+			f[k] = *c
+		}
+		mu.Lock()
+		frames = append(frames, f)
+		mu.Unlock()
+		b.Swap()
+	}
+	close(done)
+	wg.Wait()
+}
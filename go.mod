@@ -0,0 +1,3 @@
+module github.com/holygeek/tinykaboom
+
+go 1.22
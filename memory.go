@@ -0,0 +1,39 @@
+package tinykaboom
+
+// FramePixelBytes is the memory taken by a pixel of a Frame: the color pointer, the Vec it points to and the depth.
+const FramePixelBytes = 8 + 24 + 8
+
+// RenderMemory estimates the peak memory in bytes of RenderContext for cfg, the ray grid included when cfg has
+// one. It adds up the frames the stereo, motion blur and SSAA stages hold at once and the per-pixel flags of
+// the antialiasing, the garbage left for the collector aside. It's a float64 so absurd sizes don't overflow.
+func RenderMemory(cfg *RenderConfig) float64 {
+	pixels := float64(cfg.Width) * float64(cfg.Height)
+	rays := 0.0
+	if cfg.rays != nil {
+		rays = pixels * (8 + 24)
+	}
+	switch {
+	case cfg.Stereo != StereoNone:
+		eye := *cfg
+		eye.Stereo = StereoNone
+		combined := pixels
+		if cfg.Stereo == StereoSideBySide {
+			combined *= 2
+		}
+		// the left eye view is kept while the right one renders, then both are combined into a new frame
+		return RenderMemory(&eye) + (pixels+combined)*FramePixelBytes
+	case cfg.MotionBlur > 1:
+		sub := *cfg
+		sub.MotionBlur = 1
+		return RenderMemory(&sub) + pixels*FramePixelBytes // the running sum
+	case cfg.SSAA > 1:
+		big := *cfg
+		big.Width, big.Height, big.SSAA, big.rays = cfg.Width*cfg.SSAA, cfg.Height*cfg.SSAA, 1, nil
+		return rays + RenderMemory(&big) + pixels*FramePixelBytes // the downsampled frame
+	}
+	m := rays + pixels*FramePixelBytes
+	if cfg.AA != AANone && cfg.AA != AAFull {
+		m += pixels // the pixels to refine
+	}
+	return m
+}
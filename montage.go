@@ -0,0 +1,136 @@
+package tinykaboom
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// RenderSeedMontage renders a contact sheet of cols x rows explosions of consecutive seeds, starting from
+// cfg.Scene.Seed left to right and top to bottom. The cells split the cfg.Width x cfg.Height image between them
+// and are labelled with their seed.
+func RenderSeedMontage(ctx context.Context, cfg RenderConfig, cols, rows int) (*Frame, error) {
+	if cols <= 0 || rows <= 0 || cfg.Width/cols <= 0 || cfg.Height/rows <= 0 {
+		return nil, fmt.Errorf("can't split a %dx%d image into %dx%d cells", cfg.Width, cfg.Height, cols, rows)
+	}
+	f := new_frame(cfg.Width, cfg.Height)
+	for k := range f.Color {
+		f.Color[k], f.Depth[k] = NewVec(0, 0, 0), math.Inf(1)
+	}
+	cell := cfg
+	cell.Width, cell.Height = cfg.Width/cols, cfg.Height/rows
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			cell.Scene.Seed = cfg.Scene.Seed + float64(c+r*cols)
+			sub, err := RenderContext(ctx, cell)
+			if sub == nil {
+				return nil, err
+			}
+			x0, y0 := c*cell.Width, r*cell.Height
+			for j := 0; j < cell.Height; j++ {
+				copy(f.Color[x0+(y0+j)*f.Width:], sub.Color[j*cell.Width:(j+1)*cell.Width])
+				copy(f.Depth[x0+(y0+j)*f.Width:], sub.Depth[j*cell.Width:(j+1)*cell.Width])
+			}
+			f.Stats.merge(&sub.Stats)
+			draw_label(f, x0+4, y0+4, fmt.Sprint(cell.Scene.Seed))
+			if err != nil {
+				return f, err
+			}
+		}
+	}
+	return f, nil
+}
+
+// SearchSeed renders the explosions of the n consecutive seeds from cfg.Scene.Seed at a quarter of the
+// resolution and returns the most interesting one, by interest.
+func SearchSeed(ctx context.Context, cfg RenderConfig, n int) (float64, error) {
+	small := cfg
+	small.Width, small.Height, small.Checkpoint = max(1, cfg.Width/4), max(1, cfg.Height/4), nil
+	best, score := cfg.Scene.Seed, math.Inf(-1)
+	for k := 0; k < n; k++ {
+		small.Scene.Seed = cfg.Scene.Seed + float64(k)
+		f, err := RenderContext(ctx, small)
+		if err != nil {
+			return 0, err
+		}
+		if s := interest(&small, f); s > score {
+			best, score = small.Scene.Seed, s
+		}
+	}
+	return best, nil
+}
+
+// interest scores how interesting the explosion of the frame looks: the variance of the luminance over the
+// pixels where the rays hit it, for the contrast between the flames and the smoke, times the fraction of the
+// image they cover so a small puff with a lot of contrast doesn't win.
+func interest(cfg *RenderConfig, f *Frame) float64 {
+	type moments struct{ n, sum, sq float64 }
+	m := reduceTiles(cfg, f, func(f *Frame, t tile) (m moments) {
+		for j := t.y0; j < t.y1; j++ {
+			for i := t.x0; i < t.x1; i++ {
+				if !math.IsInf(f.Depth[i+j*f.Width], 1) {
+					l := f.Color[i+j*f.Width].Luminance()
+					m.n, m.sum, m.sq = m.n+1, m.sum+l, m.sq+l*l
+				}
+			}
+		}
+		return m
+	}, func(acc, p moments) moments {
+		return moments{acc.n + p.n, acc.sum + p.sum, acc.sq + p.sq}
+	}, moments{})
+	if m.n == 0 {
+		return 0
+	}
+	mean := m.sum / m.n
+	return (m.sq/m.n - mean*mean) * m.n / float64(len(f.Color))
+}
+
+// label_glyphs are 3x5 pixel glyphs for the characters of the numbers, a row per string and a column per byte.
+var label_glyphs = map[rune][5]string{
+	'0': {"###", "# #", "# #", "# #", "###"},
+	'1': {" # ", "## ", " # ", " # ", "###"},
+	'2': {"###", "  #", "###", "#  ", "###"},
+	'3': {"###", "  #", "###", "  #", "###"},
+	'4': {"# #", "# #", "###", "  #", "  #"},
+	'5': {"###", "#  ", "###", "  #", "###"},
+	'6': {"###", "#  ", "###", "# #", "###"},
+	'7': {"###", "  #", "  #", "  #", "  #"},
+	'8': {"###", "# #", "###", "# #", "###"},
+	'9': {"###", "# #", "###", "  #", "###"},
+	'-': {"   ", "   ", "###", "   ", "   "},
+	'.': {"   ", "   ", "   ", "   ", " # "},
+	'e': {"   ", "###", "###", "#  ", "###"},
+	'+': {"   ", " # ", "###", " # ", "   "},
+}
+
+// draw_label writes text in white at (x,y) of the frame with 2x2 pixel dots, each dot shadowed in black so the
+// label reads over the bright flames as well as over the background. Unknown characters are left blank.
+func draw_label(f *Frame, x, y int, text string) {
+	const dot = 2
+	set := func(i, j int, c *Vec) {
+		if i >= 0 && i < f.Width && j >= 0 && j < f.Height {
+			f.Color[i+j*f.Width] = c.Clone() // no cells sharing a vector
+		}
+	}
+	for _, shadow := range []bool{true, false} {
+		c, off := NewVec(1, 1, 1), 0
+		if shadow {
+			c, off = NewVec(0, 0, 0), 1
+		}
+		for n, r := range text {
+			g := label_glyphs[r]
+			for row, line := range g {
+				for col := range line {
+					if line[col] != '#' {
+						continue
+					}
+					for dj := 0; dj < dot; dj++ {
+						for di := 0; di < dot; di++ {
+							set(x+(4*n+col)*dot+di+off, y+row*dot+dj+off, c)
+						}
+					}
+				}
+			}
+		}
+	}
+}
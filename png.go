@@ -0,0 +1,21 @@
+package tinykaboom
+
+import (
+	"image"
+	"image/png"
+	"io"
+	"math"
+)
+
+// WritePNG encodes the framebuffer as an 8-bit opaque PNG, the channels clamped to [0,1] like WritePPM does.
+func WritePNG(w io.Writer, framebuffer []*Vec, width, height int) error {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i, v := range framebuffer[:width*height] {
+		p := img.Pix[4*i : 4*i+4]
+		p[0] = byte(math.Max(0, math.Min(255, 255*v.x)))
+		p[1] = byte(math.Max(0, math.Min(255, 255*v.y)))
+		p[2] = byte(math.Max(0, math.Min(255, 255*v.z)))
+		p[3] = 255
+	}
+	return png.Encode(w, img)
+}
@@ -0,0 +1,395 @@
+package tinykaboom
+
+import (
+	"math"
+	"sort"
+)
+
+// ColorSpace is the encoding of the values of the graded image.
+type ColorSpace int
+
+const (
+	ColorLinear ColorSpace = iota // the values as rendered
+	ColorSRGB                     // the sRGB transfer function, see srgb_encode
+	ColorGamma                    // a plain 1/2.2 power, see gamma_encode
+)
+
+// ColorSpaces maps the -color-space names to the encodings.
+var ColorSpaces = map[string]ColorSpace{
+	"linear": ColorLinear,
+	"srgb":   ColorSRGB,
+	"gamma":  ColorGamma,
+}
+
+// Grading is the post-processing turning a rendered frame into the image written out. Apply runs its steps in
+// the order of the fields. NewGrading returns the one leaving the frame as it is.
+type Grading struct {
+	AutoExposure    bool              // scale the colors by the Exposure of the frame statistics
+	RejectFireflies bool              // replace the isolated pixels much brighter than their neighbors, see reject_fireflies
+	Denoise         float64           // strength of the edge-aware smoothing, 0 for none
+	RadialBlur      float64           // strength in [0,1] of the blur streaking the image outwards, 0 for none
+	ToneMap         func(c *Vec) *Vec // one of ToneMaps, nil for none
+	Contrast        float64           // factor scaling the channels away from mid-gray, 1 for none
+	Curves          [3]ToneCurve      // grading of the red, green and blue channels
+	Vignette        float64           // darkening of the corners, 0 for none
+	Grain           float64           // amount of film grain, 0 for none
+	GrainSeed       uint64            // seed of the grain pattern, give every frame of an animation its own
+	ColorSpace      ColorSpace
+	ClampNegative   bool      // set the negative channels to 0 last
+	Debug           DebugMode // DebugClip shows where the graded channels are out of [0,1] instead of ClampNegative
+}
+
+// NewGrading returns the grading leaving the frames as they are.
+func NewGrading() Grading {
+	return Grading{Contrast: 1, Curves: [3]ToneCurve{IdentityCurve, IdentityCurve, IdentityCurve}}
+}
+
+// Apply grades f in place. The filters replace the color slice of f rather than writing into it.
+func (g *Grading) Apply(f *Frame) {
+	if g.AutoExposure {
+		k := f.Stats.Exposure()
+		for i, c := range f.Color {
+			f.Color[i] = c.Mul(k)
+		}
+	}
+	if g.RejectFireflies {
+		f.Color = reject_fireflies(f)
+	}
+	if g.Denoise > 0 {
+		f.Color = denoise_bilateral(f, g.Denoise)
+	}
+	if g.RadialBlur > 0 {
+		f.Color = radial_blur(f, g.RadialBlur)
+	}
+	if g.ToneMap != nil {
+		tonemap(f, g.ToneMap)
+	}
+	if g.Contrast != 1 {
+		adjust_contrast(f, g.Contrast)
+	}
+	if g.Curves != [3]ToneCurve{IdentityCurve, IdentityCurve, IdentityCurve} {
+		rgb_curves(f, g.Curves)
+	}
+	if g.Vignette != 0 {
+		vignette(f, g.Vignette)
+	}
+	if g.Grain != 0 {
+		film_grain(f, g.Grain, g.GrainSeed)
+	}
+
+	switch g.ColorSpace {
+	case ColorSRGB:
+		srgb_encode(f)
+	case ColorGamma:
+		gamma_encode(f, 2.2)
+	}
+
+	if g.Debug == DebugClip {
+		debug_clip(f)
+	} else if g.ClampNegative {
+		clamp_negative(f)
+	}
+}
+
+// denoise_bilateral smooths the frame with a bilateral filter: the neighbors are weighted by their distance to
+// the pixel, by how different their color is and by how different their depth is. The depth term keeps the
+// silhouette sharp, the background is never blended into the explosion and vice versa.
+func denoise_bilateral(f *Frame, strength float64) []*Vec {
+	const (
+		radius  = 2
+		sigma_s = 1.5  // spatial falloff, in pixels
+		sigma_d = 0.05 // depth falloff, in scene units
+	)
+	sigma_c := 0.2 * strength // the stronger the filter, the more different colors it blends
+
+	out := make([]*Vec, len(f.Color))
+	for j := 0; j < f.Height; j++ {
+		for i := 0; i < f.Width; i++ {
+			c := f.Color[i+j*f.Width]
+			d := f.Depth[i+j*f.Width]
+			sum, weight := NewVec(0, 0, 0), 0.0
+			for dj := -radius; dj <= radius; dj++ {
+				for di := -radius; di <= radius; di++ {
+					x, y := i+di, j+dj
+					if x < 0 || y < 0 || x >= f.Width || y >= f.Height {
+						continue
+					}
+					nc := f.Color[x+y*f.Width]
+					nd := f.Depth[x+y*f.Width]
+					if math.IsInf(d, 1) != math.IsInf(nd, 1) {
+						continue // across the silhouette
+					}
+					w := math.Exp(-float64(di*di+dj*dj) / (2 * sigma_s * sigma_s))
+					dc := nc.Sub(c)
+					w *= math.Exp(-dc.Dot(dc) / (2 * sigma_c * sigma_c))
+					if !math.IsInf(d, 1) {
+						w *= math.Exp(-(nd - d) * (nd - d) / (2 * sigma_d * sigma_d))
+					}
+					sum = sum.Add(nc.Mul(w))
+					weight += w
+				}
+			}
+			out[i+j*f.Width] = sum.Mul(1 / weight)
+		}
+	}
+	return out
+}
+
+// reject_fireflies replaces the isolated pixels much brighter than their neighborhood by the median of their 8
+// neighbors. A pixel only counts as isolated if at most one of its neighbors is bright as well, so the genuine
+// highlights, which span several pixels, are kept.
+func reject_fireflies(f *Frame) []*Vec {
+	const ratio = 3 // how many times brighter than the median of its neighbors a firefly is
+
+	out := make([]*Vec, len(f.Color))
+	copy(out, f.Color)
+	var r, g, b, l [8]float64
+	for j := 1; j+1 < f.Height; j++ {
+		for i := 1; i+1 < f.Width; i++ {
+			n := 0
+			for dj := -1; dj <= 1; dj++ {
+				for di := -1; di <= 1; di++ {
+					if di == 0 && dj == 0 {
+						continue
+					}
+					c := f.Color[i+di+(j+dj)*f.Width]
+					r[n], g[n], b[n], l[n] = c.x, c.y, c.z, c.Luminance()
+					n++
+				}
+			}
+			threshold := ratio*median8(l) + 1e-3
+			if f.Color[i+j*f.Width].Luminance() <= threshold {
+				continue
+			}
+			bright := 0
+			for _, v := range l {
+				if v > threshold {
+					bright++
+				}
+			}
+			if bright <= 1 {
+				out[i+j*f.Width] = NewVec(median8(r), median8(g), median8(b))
+			}
+		}
+	}
+	return out
+}
+
+func median8(v [8]float64) float64 {
+	sort.Float64s(v[:])
+	return (v[3] + v[4]) / 2
+}
+
+// radial_blur averages every pixel of the frame with the pixels on the segment towards the image center, whose
+// length is strength times the distance to the center, for a blast streaking outwards.
+func radial_blur(f *Frame, strength float64) []*Vec {
+	const samples = 16
+	out := make([]*Vec, len(f.Color))
+	cx, cy := float64(f.Width)/2, float64(f.Height)/2
+	for j := 0; j < f.Height; j++ {
+		for i := 0; i < f.Width; i++ {
+			x, y := float64(i)+0.5, float64(j)+0.5
+			sum := NewVec(0, 0, 0)
+			for k := 0; k < samples; k++ {
+				t := 1 - strength*float64(k)/samples
+				si := min(max(int(cx+(x-cx)*t), 0), f.Width-1)
+				sj := min(max(int(cy+(y-cy)*t), 0), f.Height-1)
+				sum = sum.Add(f.Color[si+sj*f.Width])
+			}
+			out[i+j*f.Width] = sum.Mul(1.0 / samples)
+		}
+	}
+	return out
+}
+
+// ToneMaps maps the -tonemap names to the functions compressing the colors of any brightness into [0,1), none
+// leaving them as they are.
+var ToneMaps = map[string]func(c *Vec) *Vec{
+	"none":           nil,
+	"reinhard":       per_channel(tonemap_reinhard),
+	"aces":           per_channel(tonemap_aces),
+	"reinhard-gamma": toneMap,
+}
+
+// per_channel returns the tone mapping passing each channel through curve.
+func per_channel(curve func(x float64) float64) func(c *Vec) *Vec {
+	return func(c *Vec) *Vec { return NewVec(curve(c.x), curve(c.y), curve(c.z)) }
+}
+
+// toneMap is the classic display mapping of the linear color v, leaving v as it is: the Reinhard curve then the
+// 1/2.2 gamma on every channel, so the hot colors above 1 roll off instead of clipping.
+func toneMap(v *Vec) *Vec {
+	curve := func(x float64) float64 { return math.Pow(tonemap_reinhard(x), 1/2.2) }
+	return NewVec(curve(v.x), curve(v.y), curve(v.z))
+}
+
+// tonemap_reinhard is x/(1+x), rolling the highlights off slowly but flattening the midtones.
+func tonemap_reinhard(x float64) float64 {
+	x = math.Max(0, x)
+	return x / (1 + x)
+}
+
+// tonemap_aces is the Narkowicz fit of the ACES filmic curve, with a toe deepening the blacks and a shoulder
+// bringing the highlights to white instead of a dull gray.
+func tonemap_aces(x float64) float64 {
+	const a, b, c, d, e = 2.51, 0.03, 2.43, 0.59, 0.14
+	x = math.Max(0, x)
+	return math.Min(1, x*(a*x+b)/(x*(c*x+d)+e))
+}
+
+// tonemap replaces every color of the frame by its tone mapping.
+func tonemap(f *Frame, m func(c *Vec) *Vec) {
+	for i, c := range f.Color {
+		f.Color[i] = m(c)
+	}
+}
+
+// adjust_contrast scales the color channels of the frame by k around mid-gray and clamps them to [0,1].
+func adjust_contrast(f *Frame, k float64) {
+	clamp := func(x float64) float64 { return math.Max(0, math.Min(1, x)) }
+	for i, c := range f.Color {
+		f.Color[i] = NewVec(clamp((clamp(c.x)-0.5)*k+0.5), clamp((clamp(c.y)-0.5)*k+0.5), clamp((clamp(c.z)-0.5)*k+0.5))
+	}
+}
+
+// ToneCurve is a lift/gamma/gain grading curve of a color channel: the lift raises the blacks leaving the whites
+// alone, the gain scales the whole range and the gamma above 1 brightens the midtones, below 1 darkens them.
+type ToneCurve struct {
+	Lift, Gamma, Gain float64
+}
+
+// IdentityCurve leaves the channel as it is.
+var IdentityCurve = ToneCurve{Lift: 0, Gamma: 1, Gain: 1}
+
+func (c ToneCurve) apply(x float64) float64 {
+	x = c.Gain * (x + c.Lift*(1-x))
+	if c.Gamma != 1 {
+		x = math.Pow(math.Max(0, x), 1/c.Gamma)
+	}
+	return x
+}
+
+// rgb_curves grades the red, green and blue channels of the frame with their own curves.
+func rgb_curves(f *Frame, curves [3]ToneCurve) {
+	for i, c := range f.Color {
+		f.Color[i] = NewVec(curves[0].apply(c.x), curves[1].apply(c.y), curves[2].apply(c.z))
+	}
+}
+
+// srgb_encode converts the linear channels of the frame to sRGB with the piecewise transfer function of the
+// standard: a linear segment near black, then a 1/2.4 power with an offset, close to but not a 2.2 gamma. The
+// negatives stay on the linear segment and the values above 1 on the power curve.
+func srgb_encode(f *Frame) {
+	encode := func(x float64) float64 {
+		if x <= 0.0031308 {
+			return 12.92 * x
+		}
+		return 1.055*math.Pow(x, 1/2.4) - 0.055
+	}
+	for i, c := range f.Color {
+		f.Color[i] = NewVec(encode(c.x), encode(c.y), encode(c.z))
+	}
+}
+
+// gamma_encode raises the channels of the frame to the power 1/gamma, the negatives clamped to 0 first. With
+// -tonemap reinhard in front it is the classic c/(1+c), c^(1/2.2) display mapping of toneMap.
+func gamma_encode(f *Frame, gamma float64) {
+	encode := func(x float64) float64 { return math.Pow(math.Max(0, x), 1/gamma) }
+	for i, c := range f.Color {
+		f.Color[i] = NewVec(encode(c.x), encode(c.y), encode(c.z))
+	}
+}
+
+// clamp_negative sets the negative channels of the frame to 0, leaving the values above 1 alone.
+func clamp_negative(f *Frame) {
+	for i, c := range f.Color {
+		if c.x < 0 || c.y < 0 || c.z < 0 {
+			f.Color[i] = c.Max(NewVec(0, 0, 0))
+		}
+	}
+}
+
+// Dither adds the threshold texture mask, in units of 8-bit levels, to the frame so the truncation to 8 bits
+// rounds the channels up or down in a noise pattern instead of banding the smooth gradients.
+func Dither(f *Frame, mask *BlueNoise) {
+	for j := 0; j < f.Height; j++ {
+		for i := 0; i < f.Width; i++ {
+			f.Color[i+j*f.Width] = f.Color[i+j*f.Width].Add(NewVec(1, 1, 1).Mul(mask.At(i, j) / 255))
+		}
+	}
+}
+
+// vignette darkens the frame towards the edges, by strength in the corners, fading quadratically with the
+// distance from the center.
+func vignette(f *Frame, strength float64) {
+	cx, cy := float64(f.Width)/2, float64(f.Height)/2
+	for j := 0; j < f.Height; j++ {
+		for i := 0; i < f.Width; i++ {
+			dx, dy := (float64(i)+0.5-cx)/cx, (float64(j)+0.5-cy)/cy
+			k := math.Max(0, 1-strength*(dx*dx+dy*dy)/2) // dx²+dy² is 2 in the corners
+			f.Color[i+j*f.Width] = f.Color[i+j*f.Width].Mul(k)
+		}
+	}
+}
+
+// film_grain adds gray noise of the given amplitude to the frame. The noise pattern is a function of the pixel
+// and of seed only, give every frame of an animation its own seed for the grain to move.
+func film_grain(f *Frame, amount float64, seed uint64) {
+	for j := 0; j < f.Height; j++ {
+		for i := 0; i < f.Width; i++ {
+			n := unit_hash(seed^uint64(i)*0x9e3779b97f4a7c15^uint64(j)*0xc2b2ae3d27d4eb4f)*2 - 1 // uniform in [-1,1)
+			f.Color[i+j*f.Width] = f.Color[i+j*f.Width].Add(NewVec(n, n, n).Mul(amount))
+		}
+	}
+}
+
+// unit_hash scrambles h with the splitmix64 finalizer into a uniform value in [0,1).
+func unit_hash(h uint64) float64 {
+	h = (h ^ h>>30) * 0xbf58476d1ce4e5b9
+	h = (h ^ h>>27) * 0x94d049bb133111eb
+	h ^= h >> 31
+	return float64(h>>11) / (1 << 53)
+}
+
+// Flip mirrors the frame in place, horizontally and/or vertically.
+func Flip(f *Frame, horizontal, vertical bool) {
+	for j := 0; j < f.Height; j++ {
+		for i := 0; i < f.Width; i++ {
+			x, y := i, j
+			if horizontal {
+				x = f.Width - 1 - i
+			}
+			if vertical {
+				y = f.Height - 1 - j
+			}
+			a, b := i+j*f.Width, x+y*f.Width
+			if a < b { // each pair is swapped once
+				f.Color[a], f.Color[b] = f.Color[b], f.Color[a]
+				f.Depth[a], f.Depth[b] = f.Depth[b], f.Depth[a]
+			}
+		}
+	}
+}
+
+// CropToContent returns the smallest part of the frame holding all the pixels where the rays hit something,
+// false if there's none.
+func CropToContent(f *Frame) (*Frame, bool) {
+	x0, y0, x1, y1 := f.Width, f.Height, -1, -1
+	for j := 0; j < f.Height; j++ {
+		for i := 0; i < f.Width; i++ {
+			if !math.IsInf(f.Depth[i+j*f.Width], 1) {
+				x0, y0, x1, y1 = min(x0, i), min(y0, j), max(x1, i), max(y1, j)
+			}
+		}
+	}
+	if x1 < 0 {
+		return nil, false
+	}
+	out := new_frame(x1-x0+1, y1-y0+1)
+	for j := 0; j < out.Height; j++ {
+		copy(out.Color[j*out.Width:(j+1)*out.Width], f.Color[x0+(y0+j)*f.Width:])
+		copy(out.Depth[j*out.Width:(j+1)*out.Width], f.Depth[x0+(y0+j)*f.Width:])
+	}
+	out.Stats = f.Stats
+	return out, true
+}
@@ -0,0 +1,98 @@
+package tinykaboom
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestToneMap(t *testing.T) {
+	tests := []struct {
+		in, want *Vec
+	}{
+		{NewVec(0, 0, 0), NewVec(0, 0, 0)},
+		{NewVec(1, 1, 1), NewVec(math.Pow(0.5, 1/2.2), math.Pow(0.5, 1/2.2), math.Pow(0.5, 1/2.2))},
+		{NewVec(3, 0.25, -1), NewVec(math.Pow(0.75, 1/2.2), math.Pow(0.2, 1/2.2), 0)},
+	}
+	for _, tt := range tests {
+		in := *tt.in
+		got := toneMap(tt.in)
+		if d := got.Sub(tt.want); d.Norm() > 1e-12 {
+			t.Errorf("toneMap(%v) = %v, want %v", &in, got, tt.want)
+		}
+		if *tt.in != in {
+			t.Errorf("toneMap modified its argument %v into %v", &in, tt.in)
+		}
+	}
+	for _, x := range []float64{10, 1e3, 1e6} { // the hot colors roll off towards white without reaching it
+		if c := toneMap(NewVec(x, x, x)); !(c.x < 1) || c.x < toneMap(NewVec(x/10, 0, 0)).x {
+			t.Errorf("toneMap(%g) = %v, want increasing below 1", x, c)
+		}
+	}
+}
+
+// TestToneMapPipeline checks that -tonemap reinhard-gamma is -tonemap reinhard followed by -color-space gamma.
+func TestToneMapPipeline(t *testing.T) {
+	frame := func() *Frame {
+		f := new_frame(3, 1)
+		f.Color[0], f.Color[1], f.Color[2] = NewVec(0, 0.5, 1), NewVec(2, 4, 8), NewVec(-1, 0.01, 100)
+		return f
+	}
+	a, b := frame(), frame()
+	g := NewGrading()
+	g.ToneMap = ToneMaps["reinhard-gamma"]
+	g.Apply(a)
+	g.ToneMap, g.ColorSpace = ToneMaps["reinhard"], ColorGamma
+	g.Apply(b)
+	for i := range a.Color {
+		if *a.Color[i] != *b.Color[i] {
+			t.Errorf("pixel %d: reinhard-gamma gives %v, reinhard then gamma %v", i, a.Color[i], b.Color[i])
+		}
+	}
+}
+
+// TestNoAliasing checks that every pixel of a rendered and post-processed frame has a vector of its own, so
+// changing one pixel in place never changes another.
+func TestNoAliasing(t *testing.T) {
+	cfg := RenderConfig{Width: 32, Height: 24, FOV: math.Pi / 3, Scene: NewScene(), AA: AAAdaptive, AASamples: 2, AAThreshold: 0.1}
+	f, err := RenderFrame(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unique := func(what string, f *Frame) {
+		t.Helper()
+		seen := map[*Vec]int{}
+		for k, c := range f.Color {
+			if other, ok := seen[c]; ok {
+				t.Fatalf("%s: the pixels %d and %d share the vector %p", what, other, k, c)
+			}
+			seen[c] = k
+		}
+	}
+	unique("render", f)
+
+	g := NewGrading()
+	g.AutoExposure, g.RejectFireflies, g.Denoise, g.RadialBlur = true, true, 0.5, 0.2
+	g.ToneMap, g.Contrast, g.Vignette, g.Grain, g.ColorSpace = ToneMaps["aces"], 1.2, 0.3, 0.01, ColorSRGB
+	g.Apply(f)
+	unique("graded", f)
+	Flip(f, true, true)
+	unique("flipped", f)
+	if crop, ok := CropToContent(f); ok {
+		unique("cropped", crop)
+	}
+
+	montage, err := RenderSeedMontage(context.Background(), RenderConfig{Width: 64, Height: 48, FOV: math.Pi / 3, Scene: NewScene()}, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unique("labeled montage", montage)
+
+	c := f.Clone()
+	unique("clone", c)
+	was := *f.Color[1]
+	c.Color[1].x += 1 // in place, like the code holding a frame may
+	if *f.Color[1] != was {
+		t.Errorf("changing the clone changed the original pixel to %v", f.Color[1])
+	}
+}
@@ -0,0 +1,62 @@
+package tinykaboom
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Progress counts the pixels of the render passes completed by forEachPixel. The workers add a row of their
+// tile at a time with atomic operations, so it can be read while they render without slowing them down.
+type Progress struct {
+	done, total atomic.Int64
+}
+
+// start adds the pixels of a render pass to the total, nothing when p is nil like all the methods.
+func (p *Progress) start(pixels int) {
+	if p != nil {
+		p.total.Add(int64(pixels))
+	}
+}
+
+func (p *Progress) add(pixels int) {
+	if p != nil {
+		p.done.Add(int64(pixels))
+	}
+}
+
+// Fraction is the fraction of the pixels of the passes started so far that are done: a later pass, like the
+// antialiasing one, adds its pixels to the total and makes it go down again.
+func (p *Progress) Fraction() float64 {
+	total := p.total.Load()
+	if total == 0 {
+		return 0
+	}
+	return float64(p.done.Load()) / float64(total)
+}
+
+// Report prints the percentage done of p to w every period, on a single line rewritten each time, until stop is
+// called. stop prints the time elapsed since Report was.
+func (p *Progress) Report(w io.Writer, period time.Duration) (stop func()) {
+	start := time.Now()
+	ticker := time.NewTicker(period)
+	quit, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Fprintf(w, "\r%5.1f%%", 100*p.Fraction())
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(quit)
+		<-exited
+		fmt.Fprintf(w, "\r%5.1f%% in %v\n", 100*p.Fraction(), time.Since(start).Round(time.Millisecond))
+	}
+}
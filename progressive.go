@@ -0,0 +1,56 @@
+package tinykaboom
+
+import (
+	"context"
+	"errors"
+	"math"
+)
+
+// RenderProgressive renders the image one antialiasing sample per pixel at a time, for the previews converging
+// to the final image. After each of the cfg.AASamples² passes the running average of the samples rendered so
+// far is handed to onPass, numbered from 1; onPass mustn't modify the frame. The last pass is the image of the
+// supersampling of every pixel with the full grid, sample for sample. CheapAA isn't used. The exposure
+// statistics are those of the running average.
+func RenderProgressive(cfg RenderConfig, onPass func(pass int, f *Frame) error) (*Frame, error) {
+	return RenderProgressiveContext(context.Background(), cfg, onPass)
+}
+
+func RenderProgressiveContext(ctx context.Context, cfg RenderConfig, onPass func(pass int, f *Frame) error) (*Frame, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Stereo != StereoNone || cfg.MotionBlur > 1 || cfg.SSAA > 1 {
+		return nil, errors.New("the progressive render doesn't do stereo, motion blur or supersampling the whole image")
+	}
+	n := cfg.AASamples
+	if n <= 0 {
+		n = 1
+	}
+	f := new_frame(cfg.Width, cfg.Height)
+	sums := make([]*Vec, len(f.Color))
+	for k := range sums {
+		sums[k], f.Depth[k] = NewVec(0, 0, 0), math.Inf(1)
+	}
+	for pass := 0; pass < n*n; pass++ {
+		a, b := pass%n, pass/n // in the order supersample adds them up
+		err := forEachPixel(ctx, &cfg, func(cfg *RenderConfig, i, j int) {
+			x, y := aa_sample_point(cfg, i, screen_row(cfg, j), a, b, n)
+			c, d := renderSample(cfg, x, y)
+			k := i + j*cfg.Width
+			sums[k] = sums[k].Add(c)
+			f.Color[k] = sums[k].Mul(1 / float64(pass+1))
+			f.Depth[k] = math.Min(f.Depth[k], d)
+		})
+		if err != nil {
+			fill_background(&cfg, f)
+			return f, err
+		}
+		f.Stats.luminance = luminance_histogram(&cfg, f)
+		if onPass != nil {
+			if err := onPass(pass+1, f); err != nil {
+				return f, err
+			}
+		}
+	}
+	return f, nil
+}
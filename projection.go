@@ -0,0 +1,59 @@
+package tinykaboom
+
+import "math"
+
+// Projection selects how the pixels map to the directions of the camera rays.
+type Projection int
+
+const (
+	ProjectionPerspective Projection = iota // flat image plane, the straight lines stay straight
+	ProjectionCylindrical                   // the columns sweep RenderConfig.HFOV around the vertical axis, perspective vertically
+)
+
+// Projections maps the -projection names to the camera projections.
+var Projections = map[string]Projection{
+	"perspective": ProjectionPerspective,
+	"cylindrical": ProjectionCylindrical,
+}
+
+// cylindrical_ray_dir is the direction of the ray through the point (x,y) of the image, in pixel units from
+// the top left corner, for the cylindrical projection. The vertical field of view is cfg.FOV at the center column.
+func cylindrical_ray_dir(cfg *RenderConfig, x, y float64) *Vec {
+	width, height := float64(cfg.Width), float64(cfg.Height)
+	zoom := cfg.Zoom
+	if zoom == 0 {
+		zoom = 1
+	}
+	azimuth := (x/width - 0.5) * cfg.HFOV / zoom
+	focal := height / (2.0 * math.Tan(cfg.FOV/2.0)) * zoom // distance to the cylinder of the image, in pixels
+	return NewVec(focal*math.Sin(azimuth), height/2.0-y, -focal*math.Cos(azimuth)).Normalize(1)
+}
+
+// project is the inverse of camera_ray: it returns the point (x,y) of the image plane the point p is seen at and
+// its distance to the camera. It reports false for the points behind a perspective camera.
+func project(cfg *RenderConfig, p *Vec) (x, y, dist float64, ok bool) {
+	d := p.Sub(cfg.Scene.Camera)
+	dist = d.Norm()
+	if r := cfg.Scene.Roll; r != 0 { // back into the frame of the unrolled camera
+		sin, cos := math.Sincos(r)
+		d = NewVec(d.x*cos+d.y*sin, -d.x*sin+d.y*cos, d.z)
+	}
+	width, height := float64(cfg.Width), float64(cfg.Height)
+	zoom := cfg.Zoom
+	if zoom == 0 {
+		zoom = 1
+	}
+	focal := height / (2.0 * math.Tan(cfg.FOV/2.0)) * zoom
+	if cfg.Projection == ProjectionCylindrical {
+		azimuth := math.Atan2(d.x, -d.z)
+		return (azimuth*zoom/cfg.HFOV + 0.5) * width, height/2.0 - d.y*focal/math.Hypot(d.x, d.z), dist, true
+	}
+	if d.z >= 0 {
+		return 0, 0, dist, false
+	}
+	par := cfg.PixelAspect
+	if par == 0 {
+		par = 1
+	}
+	return width/2.0 - d.x*focal/d.z/par, height/2.0 + d.y*focal/d.z, dist, true
+}
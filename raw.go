@@ -0,0 +1,37 @@
+package tinykaboom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// WriteRawF32 dumps the framebuffer values as they are, for analysis tools: the width and the height as
+// little-endian uint32, then the pixels row by row from the top left corner as little-endian float32 r, g, b.
+func WriteRawF32(w io.Writer, framebuffer []*Vec, width, height int) error {
+	return writeRawF32Order(w, framebuffer, width, height, binary.LittleEndian)
+}
+
+// WriteRawF32BE is WriteRawF32 in big-endian byte order.
+func WriteRawF32BE(w io.Writer, framebuffer []*Vec, width, height int) error {
+	return writeRawF32Order(w, framebuffer, width, height, binary.BigEndian)
+}
+
+func writeRawF32Order(w io.Writer, framebuffer []*Vec, width, height int, order binary.ByteOrder) error {
+	b := &bytes.Buffer{}
+	var buf [4]byte
+	u32 := func(v uint32) {
+		order.PutUint32(buf[:], v)
+		b.Write(buf[:])
+	}
+	u32(uint32(width))
+	u32(uint32(height))
+	for _, v := range framebuffer[:width*height] {
+		u32(math.Float32bits(float32(v.x)))
+		u32(math.Float32bits(float32(v.y)))
+		u32(math.Float32bits(float32(v.z)))
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
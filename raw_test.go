@@ -0,0 +1,41 @@
+package tinykaboom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestWriteRawF32(t *testing.T) {
+	fb := []*Vec{NewVec(0, 0.5, 1), NewVec(-1, 2.25, 1e-3), NewVec(3, 4, 5), NewVec(0.1, 0.2, 0.3), NewVec(7, 8, 9), NewVec(1, 1, 1)}
+	const width, height = 3, 2
+	orders := []struct {
+		write func(b *bytes.Buffer) error
+		order binary.ByteOrder
+	}{
+		{func(b *bytes.Buffer) error { return WriteRawF32(b, fb, width, height) }, binary.LittleEndian},
+		{func(b *bytes.Buffer) error { return WriteRawF32BE(b, fb, width, height) }, binary.BigEndian},
+	}
+	for _, o := range orders {
+		var b bytes.Buffer
+		if err := o.write(&b); err != nil {
+			t.Fatal(err)
+		}
+		var header [2]uint32
+		pixels := make([]float32, 3*width*height)
+		if err := binary.Read(&b, o.order, &header); err != nil {
+			t.Fatal(err)
+		}
+		if err := binary.Read(&b, o.order, pixels); err != nil {
+			t.Fatal(err)
+		}
+		if header != [2]uint32{width, height} || b.Len() != 0 {
+			t.Errorf("%v: the header is %v with %d bytes left after the pixels, want %v and none", o.order, header, b.Len(), [2]uint32{width, height})
+		}
+		for k, v := range fb {
+			if got := [3]float32{pixels[3*k], pixels[3*k+1], pixels[3*k+2]}; got != [3]float32{float32(v.x), float32(v.y), float32(v.z)} {
+				t.Errorf("%v: pixel %d reads back as %v, want %v", o.order, k, got, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package tinykaboom
+
+import "sync"
+
+// reduceTiles computes the partial result of every cfg.TileSize tile of f on NumWorkers(cfg) goroutines, then
+// folds them into zero with merge one tile after the other from the top left. The partials are merged in the
+// same order whatever the number of workers and whichever worker computed them, so a floating point result
+// doesn't change with the number of CPUs.
+func reduceTiles[T any](cfg *RenderConfig, f *Frame, partial func(f *Frame, t tile) T, merge func(acc, p T) T, zero T) T {
+	size := cfg.TileSize
+	if size <= 0 {
+		size = f.Width
+	}
+	tiles := splitTiles(f.Width, f.Height, size)
+	partials := make([]T, len(tiles))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range NumWorkers(cfg) {
+		wg.Add(1)
+		go (func() {
+			for k := range next {
+				partials[k] = partial(f, tiles[k])
+			}
+			wg.Done()
+		})()
+	}
+	for k := range tiles {
+		next <- k
+	}
+	close(next)
+	wg.Wait()
+	acc := zero
+	for _, p := range partials {
+		acc = merge(acc, p)
+	}
+	return acc
+}
+
+// luminance_histogram returns the histogram of the luminance of the pixels of f.
+func luminance_histogram(cfg *RenderConfig, f *Frame) histogram {
+	return reduceTiles(cfg, f, func(f *Frame, t tile) (h histogram) {
+		for j := t.y0; j < t.y1; j++ {
+			for i := t.x0; i < t.x1; i++ {
+				h.add(f.Color[i+j*f.Width])
+			}
+		}
+		return h
+	}, func(acc, p histogram) histogram {
+		acc.merge(&p)
+		return acc
+	}, histogram{})
+}
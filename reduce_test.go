@@ -0,0 +1,62 @@
+package tinykaboom
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// TestReduceWorkers renders the same scene on 1, 2 and 8 workers and checks the auto-exposed images are the same
+// bytes, the histograms of the render and of luminance_histogram giving the same exposure.
+func TestReduceWorkers(t *testing.T) {
+	var want []byte
+	var exposure float64
+	for _, workers := range []int{1, 2, 8} {
+		cfg := RenderConfig{Width: 96, Height: 72, FOV: math.Pi / 3, Scene: NewScene(), TileSize: 16, Workers: workers}
+		f, err := RenderFrame(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := luminance_histogram(&cfg, f)
+		if e := h.exposure(); workers == 1 {
+			exposure = e
+		} else if e != exposure {
+			t.Errorf("%d workers: luminance_histogram gives the exposure %v, 1 worker %v", workers, e, exposure)
+		}
+		if e := f.Stats.Exposure(); e != exposure {
+			t.Errorf("%d workers: the render statistics give the exposure %v, luminance_histogram %v", workers, e, exposure)
+		}
+		g := NewGrading()
+		g.AutoExposure = true
+		g.Apply(f)
+		var b bytes.Buffer
+		if err := WritePPM(&b, f.Color, f.Width, f.Height); err != nil {
+			t.Fatal(err)
+		}
+		if workers == 1 {
+			want = b.Bytes()
+		} else if !bytes.Equal(b.Bytes(), want) {
+			t.Errorf("%d workers: the auto-exposed image differs from the one of 1 worker", workers)
+		}
+	}
+}
+
+// BenchmarkHistogram builds the luminance histogram of a 1000x1000 frame on up to hundreds of workers, each
+// filling a histogram of its own merged afterwards.
+func BenchmarkHistogram(b *testing.B) {
+	f := new_frame(1000, 1000)
+	for k := range f.Color {
+		x := unit_hash(uint64(k))
+		f.Color[k] = NewVec(x, x*x, 1-x)
+	}
+	for _, workers := range []int{1, 8, 64, 256} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			cfg := RenderConfig{Width: f.Width, Height: f.Height, TileSize: 32, Workers: workers}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				luminance_histogram(&cfg, f)
+			}
+		})
+	}
+}
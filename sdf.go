@@ -0,0 +1,39 @@
+package tinykaboom
+
+import "math"
+
+// SDF is the signed distance from the point p, relative to the center of the explosion, to the surface of a shape
+// before the noise displaces it: negative inside, positive outside. The noise only pushes the surface inwards,
+// so a shape fitting in the sphere_radius sphere stays inside the bound of the sphere tracing, Scene.Radius
+// scaling both alike. The larger ones need Scene.NoDiscard. It mustn't keep p, which RenderConfig.VecPool
+// recycles once the ray is traced.
+type SDF func(p *Vec) float64
+
+// SDFs maps the -sdf names to the shapes.
+var SDFs = map[string]SDF{
+	"fireball": sdf_fireball,
+	"box":      sdf_box,
+	"torus":    sdf_torus,
+}
+
+// sdf_fireball is the sphere of the original explosion.
+func sdf_fireball(p *Vec) float64 {
+	return p.Norm() - sphere_radius
+}
+
+// sdf_box is an axis aligned cube, its corners just inside the bounding sphere.
+func sdf_box(p *Vec) float64 {
+	const half = 0.85 // half of the side, the corners are 0.85√3 ≈ 1.47 away from the center
+	q := p.Abs().Sub(NewVec(half, half, half))
+	outside := q.Max(NewVec(0, 0, 0)).Norm()
+	inside := math.Min(math.Max(q.x, math.Max(q.y, q.z)), 0)
+	return outside + inside
+}
+
+// sdf_torus is a ring facing the default camera, in the xy plane.
+func sdf_torus(p *Vec) float64 {
+	const minor = sphere_radius / 3
+	const major = sphere_radius - minor
+	q := math.Hypot(math.Hypot(p.x, p.y)-major, p.z)
+	return q - minor
+}
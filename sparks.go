@@ -0,0 +1,50 @@
+package tinykaboom
+
+import "math"
+
+const (
+	spark_lifetime = 1.5 // seconds from the surface of the fireball to burning out
+	spark_gravity  = 1.0 // downward acceleration of the sparks, in units per second²
+)
+
+// spark returns the position and the brightness, in [0,1], of the spark number k of the scene. Every spark
+// leaves the fireball in its own direction and at its own speed, taken from the seed, and is reborn every
+// spark_lifetime seconds, at its own phase so the sparks fly out continuously.
+func spark(s *Scene, k int) (*Vec, float64) {
+	h := math.Float64bits(s.Seed) ^ uint64(k)*0x9e3779b97f4a7c15
+	u := func(n uint64) float64 { return unit_hash(h ^ n*0xc2b2ae3d27d4eb4f) }
+	z, phi := 2*u(1)-1, 2*math.Pi*u(2) // uniform direction on the sphere
+	r := math.Sqrt(1 - z*z)
+	dir := NewVec(r*math.Cos(phi), r*math.Sin(phi), z)
+	speed := 1 + 1.5*u(3)
+	age := math.Mod(s.Time+u(4)*spark_lifetime, spark_lifetime)
+	pos := s.Center.MulAdd(dir, 0.7*SceneRadius(s)+speed*age)
+	pos.y -= spark_gravity * age * age / 2
+	return pos, 1 - age/spark_lifetime
+}
+
+// draw_sparks adds the glow of the s.Sparks sparks of the scene to the frame, a gaussian dot of a couple of
+// pixels for each spark in front of the explosion.
+func draw_sparks(cfg *RenderConfig, f *Frame) {
+	glow := NewVec(1.5, 0.6, 0.1)
+	for k := 0; k < cfg.Scene.Sparks; k++ {
+		p, brightness := spark(&cfg.Scene, k)
+		x, y, dist, ok := project(cfg, p)
+		if !ok {
+			continue
+		}
+		for j := int(y) - 2; j <= int(y)+2; j++ {
+			for i := int(x) - 2; i <= int(x)+2; i++ {
+				if i < 0 || i >= f.Width || j < 0 || j >= f.Height {
+					continue
+				}
+				at := i + screen_row(cfg, j)*f.Width
+				if f.Depth[at] < dist {
+					continue
+				}
+				dx, dy := float64(i)+0.5-x, float64(j)+0.5-y
+				f.Color[at] = f.Color[at].MulAdd(glow, brightness*math.Exp(-(dx*dx+dy*dy)/0.8))
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package tinykaboom
+
+import (
+	"context"
+	"math"
+)
+
+// StereoMode selects how the views of the two eyes are combined.
+type StereoMode int
+
+const (
+	StereoNone       StereoMode = iota
+	StereoSideBySide            // the left eye view on the left half of a double width image, the right eye on the right half
+	StereoAnaglyph              // a single image with the red channel of the left eye view and the green and blue of the right one
+)
+
+// render_stereo renders the scene from two cameras cfg.IPD apart along the right axis of the camera, the
+// original camera position being halfway between them.
+func render_stereo(ctx context.Context, cfg RenderConfig) (*Frame, error) {
+	mode := cfg.Stereo
+	cfg.Stereo = StereoNone
+	camera := cfg.Scene.Camera
+	offset := camera_right(&cfg.Scene).Mul(cfg.IPD / 2)
+
+	cfg.Scene.Camera = camera.Sub(offset)
+	left, err := RenderContext(ctx, cfg)
+	if left == nil {
+		return nil, err
+	}
+	cfg.Scene.Camera = camera.Add(offset)
+	var right *Frame
+	if err == nil {
+		right, err = RenderContext(ctx, cfg)
+		if right == nil {
+			return nil, err
+		}
+	} else { // cancelled, the right eye view is left to the background
+		right = new_frame(cfg.Width, cfg.Height)
+		fill_background(&cfg, right)
+	}
+
+	var f *Frame
+	if mode == StereoAnaglyph {
+		f = anaglyph(left, right)
+	} else {
+		f = side_by_side(left, right)
+	}
+	cfg.frames.put(left)
+	cfg.frames.put(right)
+	return f, err
+}
+
+// anaglyph combines the views for red/cyan glasses.
+func anaglyph(left, right *Frame) *Frame {
+	f := new_frame(left.Width, left.Height)
+	for i := range f.Color {
+		f.Color[i] = right.Color[i].WithX(left.Color[i].x)
+		f.Depth[i] = math.Min(left.Depth[i], right.Depth[i])
+	}
+	f.Stats = left.Stats
+	f.Stats.merge(&right.Stats)
+	return f
+}
+
+func side_by_side(left, right *Frame) *Frame {
+	w, h := left.Width, left.Height
+	f := new_frame(2*w, h)
+	for j := 0; j < h; j++ {
+		copy(f.Color[2*w*j:], left.Color[w*j:w*(j+1)])
+		copy(f.Color[2*w*j+w:], right.Color[w*j:w*(j+1)])
+		copy(f.Depth[2*w*j:], left.Depth[w*j:w*(j+1)])
+		copy(f.Depth[2*w*j+w:], right.Depth[w*j:w*(j+1)])
+	}
+	f.Stats = left.Stats
+	f.Stats.merge(&right.Stats)
+	return f
+}
@@ -1,11 +1,18 @@
-package main
+// Package tinykaboom renders the explosion of ssloy's tinykaboom: a sphere displaced by fractal noise, sphere
+// traced and shaded with a fire palette. Build a RenderConfig around NewScene and call Render, or RenderContext
+// to be able to cancel it.
+package tinykaboom
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"image"
+	"image/color"
+	"io"
 	"math"
-	"os"
 	"runtime"
 	"sync"
 )
@@ -22,6 +29,15 @@ func NewVec(x, y, z float64) *Vec {
 	}
 }
 
+func (v *Vec) String() string {
+	return fmt.Sprintf("(%g, %g, %g)", v.x, v.y, v.z)
+}
+
+// MarshalJSON encodes v as the array [x, y, z].
+func (v *Vec) MarshalJSON() ([]byte, error) {
+	return json.Marshal([3]float64{v.x, v.y, v.z})
+}
+
 func (v *Vec) Dot(o *Vec) float64 {
 	return v.x*o.x + v.y*o.y + v.z*o.z
 }
@@ -50,23 +66,396 @@ func (v *Vec) Sub(o *Vec) *Vec {
 	}
 }
 
+// MulAdd returns v + o*s, the same as v.Add(o.Mul(s)) in one call. It saves no allocation: in the march loop of
+// sphere_trace_steps neither form allocates, the compiler keeps the vectors on the stack, as BenchmarkMarch shows.
+func (v *Vec) MulAdd(o *Vec, s float64) *Vec {
+	return &Vec{
+		x: v.x + o.x*s,
+		y: v.y + o.y*s,
+		z: v.z + o.z*s,
+	}
+}
+
+func (v *Vec) Negate() *Vec {
+	return &Vec{
+		x: -v.x,
+		y: -v.y,
+		z: -v.z,
+	}
+}
+
+func (v *Vec) Abs() *Vec {
+	return &Vec{
+		x: math.Abs(v.x),
+		y: math.Abs(v.y),
+		z: math.Abs(v.z),
+	}
+}
+
+// Min returns the component-wise minimum of v and o.
+func (v *Vec) Min(o *Vec) *Vec {
+	return &Vec{
+		x: math.Min(v.x, o.x),
+		y: math.Min(v.y, o.y),
+		z: math.Min(v.z, o.z),
+	}
+}
+
+// Max returns the component-wise maximum of v and o.
+func (v *Vec) Max(o *Vec) *Vec {
+	return &Vec{
+		x: math.Max(v.x, o.x),
+		y: math.Max(v.y, o.y),
+		z: math.Max(v.z, o.z),
+	}
+}
+
+// Reflect returns the direction v mirrored by the surface of unit normal n.
+func (v *Vec) Reflect(n *Vec) *Vec {
+	return v.MulAdd(n, -2*v.Dot(n))
+}
+
+// Refract returns the unit direction v refracted by Snell's law through the surface of unit normal n, eta being
+// the refractive index on the side n points to over the one behind the surface: 1/1.5 for the outward normal
+// of glass in the air. v may come from either side. It reports false on total internal reflection, when there
+// is no refracted ray.
+func (v *Vec) Refract(n *Vec, eta float64) (*Vec, bool) {
+	cosi := -math.Max(-1, math.Min(1, v.Dot(n)))
+	if cosi < 0 {
+		return v.Refract(n.Negate(), 1/eta)
+	}
+	k := 1 - eta*eta*(1-cosi*cosi)
+	if k < 0 {
+		return nil, false
+	}
+	return v.Mul(eta).MulAdd(n, eta*cosi-math.Sqrt(k)), true
+}
+
+// Clone returns a copy of v, for a vector about to have its components set in place while other references to
+// v must not see the change. The methods never modify their receiver.
+func (v *Vec) Clone() *Vec {
+	c := *v
+	return &c
+}
+
+// X returns the x component of v.
+func (v *Vec) X() float64 { return v.x }
+
+// Y returns the y component of v.
+func (v *Vec) Y() float64 { return v.y }
+
+// Z returns the z component of v.
+func (v *Vec) Z() float64 { return v.z }
+
+// WithX returns a copy of v with its x component set to x.
+func (v *Vec) WithX(x float64) *Vec {
+	return &Vec{x: x, y: v.y, z: v.z}
+}
+
+// WithY returns a copy of v with its y component set to y.
+func (v *Vec) WithY(y float64) *Vec {
+	return &Vec{x: v.x, y: y, z: v.z}
+}
+
+// WithZ returns a copy of v with its z component set to z.
+func (v *Vec) WithZ(z float64) *Vec {
+	return &Vec{x: v.x, y: v.y, z: z}
+}
+
 func (v *Vec) Norm() float64 {
 	return math.Sqrt(v.x*v.x + v.y*v.y + v.z*v.z)
 }
 
+// AngleTo returns the angle in radians between v and o, in [0,π]. It is 0 when either is the zero vector, which
+// has no direction.
+func (v *Vec) AngleTo(o *Vec) float64 {
+	n := v.Norm() * o.Norm()
+	if n == 0 {
+		return 0
+	}
+	c := v.Dot(o) / n
+	return math.Acos(math.Max(-1, math.Min(1, c))) // rounding can push the cosine of nearly parallel vectors out of [-1,1]
+}
+
+// Luminance returns the Rec. 709 luminance of the vector taken as a linear RGB color.
+func (v *Vec) Luminance() float64 {
+	return 0.2126*v.x + 0.7152*v.y + 0.0722*v.z
+}
+
+// Normalize returns v scaled to the length l.
 func (v *Vec) Normalize(l float64) *Vec {
 	d := l / v.Norm()
-	v.x = v.x * d
-	v.y = v.y * d
-	v.z = v.z * d
-	return v
+	return &Vec{
+		x: v.x * d,
+		y: v.y * d,
+		z: v.z * d,
+	}
 }
 
 const (
 	sphere_radius   = 1.5 // all the explosion fits in a sphere with this radius. The center lies in the origin.
 	noise_amplitude = 1.0 // amount of noise applied to the sphere (towards the center)
+	noise_frequency = 3.4 // noise cells per unit of the scene along the noise field axes
+)
+
+// The values Scene.Radius, Scene.NoiseAmp and Scene.NoiseFreq default to when 0.
+const (
+	DefaultRadius         = sphere_radius
+	DefaultNoiseAmplitude = noise_amplitude
+	DefaultNoiseFrequency = noise_frequency
 )
 
+// Mat3 is a 3x3 matrix stored as its rows.
+type Mat3 [3]*Vec
+
+func (m Mat3) Apply(v *Vec) *Vec { // spelled out to stay under the inlining budget, which keeps the result off the heap in the noise loops
+	return &Vec{
+		x: m[0].x*v.x + m[0].y*v.y + m[0].z*v.z,
+		y: m[1].x*v.x + m[1].y*v.y + m[1].z*v.z,
+		z: m[2].x*v.x + m[2].y*v.y + m[2].z*v.z,
+	}
+}
+
+func (m Mat3) Mul(o Mat3) Mat3 {
+	col := func(j int) *Vec {
+		switch j {
+		case 0:
+			return NewVec(o[0].x, o[1].x, o[2].x)
+		case 1:
+			return NewVec(o[0].y, o[1].y, o[2].y)
+		}
+		return NewVec(o[0].z, o[1].z, o[2].z)
+	}
+	var r Mat3
+	for i := range r {
+		r[i] = NewVec(m[i].Dot(col(0)), m[i].Dot(col(1)), m[i].Dot(col(2)))
+	}
+	return r
+}
+
+// RotationXYZ returns the rotation about the x axis, then the y axis, then the z axis by the given angles in radians.
+func RotationXYZ(x, y, z float64) Mat3 {
+	rx := Mat3{NewVec(1, 0, 0), NewVec(0, math.Cos(x), -math.Sin(x)), NewVec(0, math.Sin(x), math.Cos(x))}
+	ry := Mat3{NewVec(math.Cos(y), 0, math.Sin(y)), NewVec(0, 1, 0), NewVec(-math.Sin(y), 0, math.Cos(y))}
+	rz := Mat3{NewVec(math.Cos(z), -math.Sin(z), 0), NewVec(math.Sin(z), math.Cos(z), 0), NewVec(0, 0, 1)}
+	return rz.Mul(ry).Mul(rx)
+}
+
+// Scene describes the explosion being rendered.
+type Scene struct {
+	NoiseRotation Mat3    // orientation of the turbulence, applied to the fractal_brownian_motion input
+	Time          float64 // animation time in seconds, the turbulence drifts through the noise field as it grows
+	Center        *Vec    // center of the explosion
+	Palette       Palette // the colors the explosion is looked up in, palette_fire or palette_fire_smooth when nil
+	PaletteCycle  float64 // how many times per second the colors cycle through the palette
+	InvertPalette bool    // look the palette up backwards, the hot colors going to the outside
+	SmoothPalette bool    // interpolate the default palette with a spline rather than linearly
+	PaletteGamma  float64 // the palette is looked up at d^PaletteGamma, below 1 the hot colors spread outwards; 0 means 1
+	PaletteBands  int     // if positive, the palette lookups are snapped to the centers of PaletteBands bands, for a posterized toon fire
+	Ambient       float64 // minimum light intensity of the surface, in [0,1]
+	Shadow        float64 // sharpness of the penumbrae of the shadows the explosion casts from the point light, 0 for no shadows
+	LightSize     float64 // radius of the spheres the point lights are for the shadows, their penumbrae widening with it; 0 for points
+	LightSamples  int     // shadow rays towards each light when LightSize is positive, light_samples when 0
+	Camera        *Vec    // position of the camera, it looks along the -z axis
+	Lights        []*Vec  // positions of the point lights, at time 0 if they orbit; their contributions add up
+	Roll          float64 // angle in radians the camera is turned counterclockwise about its view axis, tilting the horizon
+	NoisePeriod   int     // if positive, the noise field repeats every NoisePeriod units along its axes, for tileable textures
+	NoiseFreq     float64 // noise cells per unit of the scene, noise_frequency when 0; the higher, the finer the flames
+	NoiseAmp      float64 // how deep the noise carves into the shape, noise_amplitude when 0
+	Radius        float64 // the shape is scaled to fit in a sphere of this radius instead of sphere_radius, when not 0
+	GradientNoise bool    // displace the surface with gradient_noise instead of the value noise of the original
+	NoiseDims     int     // 2 for noise constant along the y axis of the rotated noise field, streaking the flames along it; 0 or 3 for 3D noise
+	Seed          float64 // selects the noise pattern, each integer giving an unrelated one
+	Evolve        float64 // how fast the seed advances, per second, so the turbulence churns instead of only drifting
+	SDF           SDF     // the shape the noise displaces, sdf_fireball when nil
+	NoDiscard     bool    // march the rays missing the bounding sphere of SceneRadius too, for an SDF extending beyond it
+	LightOrbit    float64 // how many turns per second the point lights make around the vertical axis, 0 for fixed lights
+	SmoothNormal  float64 // in [0,1], how much the shading normal is blended from the one of the noisy surface towards the one of the undisplaced shape
+
+	SpotLights []SpotLight // lights added to the point light
+	Floor      *Floor      // ground plane under the explosion, none when nil
+	Fog        *Fog        // haze over the ground, none when nil
+	Sparks     int         // number of glowing sparks flying out of the fireball
+
+	noise *noiseCache // set by forEachPixel on the copy of the scene of each worker when RenderConfig.NoiseCache is on
+	vecs  *vecArena   // set by forEachPixel on the copy of the scene of each worker when RenderConfig.VecPool is on
+}
+
+// SpotLight is a light only illuminating the surfaces inside a cone.
+type SpotLight struct {
+	Position  *Vec
+	Direction *Vec    // axis of the cone
+	Angle     float64 // angle in radians between the axis and the edge of the cone
+	Falloff   float64 // angular width in radians of the soft edge inside the cone, fading from full intensity to none
+}
+
+// Floor is a horizontal matte plane with a checkerboard pattern, lit like the surface of the explosion.
+type Floor struct {
+	Height float64 // y coordinate of the plane
+	Colors [2]*Vec // colors of the alternating squares
+	Tile   float64 // side of the squares
+}
+
+// intersect returns the distance along dir from orig to the floor, false if the ray is parallel or goes away from it.
+func (fl *Floor) intersect(orig, dir *Vec) (float64, bool) {
+	if dir.y == 0 {
+		return 0, false
+	}
+	t := (fl.Height - orig.y) / dir.y
+	return t, t > 0
+}
+
+// color is the checker color of the floor point p.
+func (fl *Floor) color(p *Vec) *Vec {
+	if int64(math.Floor(p.x/fl.Tile)+math.Floor(p.z/fl.Tile))&1 == 0 {
+		return fl.Colors[0]
+	}
+	return fl.Colors[1]
+}
+
+// smoothstep is 0 below e0, 1 above e1 and goes smoothly from one to the other in between.
+func smoothstep(e0, e1, x float64) float64 {
+	if e1 <= e0 {
+		if x < e0 {
+			return 0
+		}
+		return 1
+	}
+	t := math.Max(0, math.Min(1, (x-e0)/(e1-e0)))
+	return t * t * (3 - 2*t)
+}
+
+// intensity is the lambertian lighting of the surface point p of normal n by the spotlight.
+func (l *SpotLight) intensity(p, n *Vec) float64 {
+	to_point := p.Sub(l.Position)
+	cone := 1 - smoothstep(l.Angle-l.Falloff, l.Angle, to_point.AngleTo(l.Direction))
+	if cone == 0 {
+		return 0
+	}
+	return cone * math.Max(0, to_point.Negate().Normalize(1).Dot(n))
+}
+
+// NewScene returns the scene of the original tinykaboom render.
+func NewScene() Scene {
+	return Scene{
+		NoiseRotation: Mat3{NewVec(0.00, 0.80, 0.60), NewVec(-0.80, 0.36, -0.48), NewVec(-0.60, -0.48, 0.64)},
+		Center:        NewVec(0, 0, 0),
+		Ambient:       0.4,
+		Camera:        NewVec(0, 0, 3),
+		Lights:        []*Vec{NewVec(10, 10, 10)},
+	}
+}
+
+func finite(v *Vec) bool {
+	return !math.IsNaN(v.x+v.y+v.z) && !math.IsInf(v.x+v.y+v.z, 0)
+}
+
+// Validate reports the first problem found with the scene that would make it render as garbage.
+func (s Scene) Validate() error {
+	for i, row := range s.NoiseRotation {
+		if row == nil || !finite(row) {
+			return fmt.Errorf("invalid scene: noise rotation row %d is %v", i, row)
+		}
+	}
+	if s.Center == nil || !finite(s.Center) {
+		return fmt.Errorf("invalid scene: the center %v isn't a point", s.Center)
+	}
+	if s.Camera == nil || !finite(s.Camera) {
+		return fmt.Errorf("invalid scene: the camera position %v isn't a point", s.Camera)
+	}
+	for i, l := range s.Lights {
+		if l == nil || !finite(l) {
+			return fmt.Errorf("invalid scene: the position %v of light %d isn't a point", l, i)
+		}
+	}
+	if math.IsNaN(s.Roll) || math.IsInf(s.Roll, 0) {
+		return fmt.Errorf("invalid scene: camera roll %g", s.Roll)
+	}
+	if math.IsNaN(s.Time) || math.IsInf(s.Time, 0) {
+		return fmt.Errorf("invalid scene: time %g", s.Time)
+	}
+	if math.IsNaN(s.Seed+s.Evolve) || math.IsInf(s.Seed, 0) || math.IsInf(s.Evolve, 0) {
+		return fmt.Errorf("invalid scene: seed %g evolving at %g per second", s.Seed, s.Evolve)
+	}
+	if math.IsNaN(s.PaletteCycle) || math.IsInf(s.PaletteCycle, 0) {
+		return fmt.Errorf("invalid scene: palette cycle speed %g", s.PaletteCycle)
+	}
+	if math.IsNaN(s.LightOrbit) || math.IsInf(s.LightOrbit, 0) {
+		return fmt.Errorf("invalid scene: light orbit speed %g", s.LightOrbit)
+	}
+	if s.PaletteBands < 0 {
+		return fmt.Errorf("invalid scene: negative number of palette bands %d", s.PaletteBands)
+	}
+	if s.Sparks < 0 {
+		return fmt.Errorf("invalid scene: negative number of sparks %d", s.Sparks)
+	}
+	if !(s.NoiseFreq >= 0 && s.NoiseAmp >= 0) || math.IsInf(s.NoiseFreq+s.NoiseAmp, 0) {
+		return fmt.Errorf("invalid scene: noise frequency %g and amplitude %g", s.NoiseFreq, s.NoiseAmp)
+	}
+	if !(s.Radius >= 0) || math.IsInf(s.Radius, 0) {
+		return fmt.Errorf("invalid scene: radius %g", s.Radius)
+	}
+	if s.NoisePeriod < 0 {
+		return fmt.Errorf("invalid scene: negative noise period %d", s.NoisePeriod)
+	}
+	if s.NoiseDims != 0 && s.NoiseDims != 2 && s.NoiseDims != 3 {
+		return fmt.Errorf("invalid scene: %d noise dimensions, only 2 and 3 are supported", s.NoiseDims)
+	}
+	if !(s.PaletteGamma >= 0) || math.IsInf(s.PaletteGamma, 0) {
+		return fmt.Errorf("invalid scene: palette gamma %g", s.PaletteGamma)
+	}
+	if !(s.SmoothNormal >= 0 && s.SmoothNormal <= 1) {
+		return fmt.Errorf("invalid scene: the normal blend %g isn't in [0,1]", s.SmoothNormal)
+	}
+	if !(s.Ambient >= 0 && s.Ambient <= 1) {
+		return fmt.Errorf("invalid scene: the ambient light intensity %g isn't in [0,1]", s.Ambient)
+	}
+	if !(s.Shadow >= 0) || math.IsInf(s.Shadow, 0) {
+		return fmt.Errorf("invalid scene: shadow sharpness %g", s.Shadow)
+	}
+	if !(s.LightSize >= 0) || math.IsInf(s.LightSize, 0) {
+		return fmt.Errorf("invalid scene: light size %g", s.LightSize)
+	}
+	if s.LightSamples < 0 {
+		return fmt.Errorf("invalid scene: %d light samples", s.LightSamples)
+	}
+	if fg := s.Fog; fg != nil {
+		switch {
+		case !(fg.Density >= 0) || math.IsInf(fg.Density, 0):
+			return fmt.Errorf("invalid scene: fog density %g", fg.Density)
+		case math.IsNaN(fg.Height) || math.IsInf(fg.Height, 0):
+			return fmt.Errorf("invalid scene: fog height %g", fg.Height)
+		case !(fg.Falloff > 0) || math.IsInf(fg.Falloff, 0):
+			return fmt.Errorf("invalid scene: fog falloff %g, it must be positive", fg.Falloff)
+		case fg.Color == nil || !finite(fg.Color):
+			return fmt.Errorf("invalid scene: fog color %v", fg.Color)
+		}
+	}
+	if fl := s.Floor; fl != nil {
+		switch {
+		case math.IsNaN(fl.Height) || math.IsInf(fl.Height, 0):
+			return fmt.Errorf("invalid scene: floor height %g", fl.Height)
+		case fl.Colors[0] == nil || !finite(fl.Colors[0]) || fl.Colors[1] == nil || !finite(fl.Colors[1]):
+			return fmt.Errorf("invalid scene: floor colors %v and %v", fl.Colors[0], fl.Colors[1])
+		case !(fl.Tile > 0) || math.IsInf(fl.Tile, 0):
+			return fmt.Errorf("invalid scene: floor tile size %g isn't positive", fl.Tile)
+		}
+	}
+	for i, l := range s.SpotLights {
+		switch {
+		case l.Position == nil || !finite(l.Position):
+			return fmt.Errorf("invalid scene: spotlight %d position %v isn't a point", i, l.Position)
+		case l.Direction == nil || !finite(l.Direction) || l.Direction.Norm() == 0:
+			return fmt.Errorf("invalid scene: spotlight %d direction %v isn't a direction", i, l.Direction)
+		case !(l.Angle > 0 && l.Angle < math.Pi):
+			return fmt.Errorf("invalid scene: spotlight %d cone angle %g isn't in (0,π)", i, l.Angle)
+		case !(l.Falloff >= 0 && l.Falloff <= l.Angle):
+			return fmt.Errorf("invalid scene: spotlight %d falloff %g isn't in [0,%g]", i, l.Falloff, l.Angle)
+		}
+	}
+	return nil
+}
+
 func lerpFloat64(v0, v1, t float64) float64 {
 	return v0 + (v1-v0)*math.Max(0.0, math.Min(1.0, t))
 }
@@ -80,144 +469,1445 @@ func hash(n float64) float64 {
 	return x - math.Floor(x)
 }
 
-func noise(x *Vec) float64 {
-	p := &Vec{x: math.Floor(x.x), y: math.Floor(x.y), z: math.Floor(x.z)}
-	f := &Vec{x: x.x - p.x, y: x.y - p.y, z: x.z - p.z}
-	f = f.Mul(f.Dot(NewVec(3, 3, 3).Sub(f.Mul(2))))
+// noiseCache remembers the lattice hashes of the last noise cells looked up. Rays and the finite differences of
+// the normals sample nearby points, so the same cells come back over and over and skip the math.Sin calls of hash.
+// It isn't safe for concurrent use, forEachPixel gives each worker its own.
+type noiseCache [256]struct {
+	n, seed float64 // p.Dot(1,57,113) of the cell and the seed, the hashes only depend on them
+	ok      bool
+	hashes  [8]float64
+}
+
+func (c *noiseCache) lookup(n, seed float64) *[8]float64 {
+	e := &c[uint64(int64(n))%uint64(len(c))]
+	if !e.ok || e.n != n || e.seed != seed {
+		e.n, e.seed, e.ok = n, seed, true
+		e.hashes = lattice_hashes(n, seed)
+	}
+	return &e.hashes
+}
+
+// lattice_hashes are the hashes of the 8 corners of the noise cell n. Each integer seed hashes the lattice into
+// unrelated values, the fractional seeds blending smoothly between the two nearest ones.
+func lattice_hashes(n, seed float64) [8]float64 {
+	corners := func(n float64) [8]float64 {
+		return [8]float64{hash(n + 0), hash(n + 1), hash(n + 57), hash(n + 58), hash(n + 113), hash(n + 114), hash(n + 170), hash(n + 171)}
+	}
+	k := math.Floor(seed)
+	h := corners(n + 1e4*hash(k)) // hash(0) is 0, seed 0 is the original noise
+	if w := seed - k; w > 0 {
+		next := corners(n + 1e4*hash(k+1))
+		w = w * w * (3 - 2*w)
+		for i := range h {
+			h[i] += (next[i] - h[i]) * w
+		}
+	}
+	return h
+}
+
+func noise(x *Vec, s *Scene) float64 {
+	if s.GradientNoise {
+		return gradient_noise(x, 0, s)
+	}
+	if s.NoiseDims == 2 {
+		return noise2(x.x, x.z, s)
+	}
+	p := s.vecs.vec(Vec{x: math.Floor(x.x), y: math.Floor(x.y), z: math.Floor(x.z)})
+	f := s.vecs.vec(Vec{x: x.x - p.x, y: x.y - p.y, z: x.z - p.z})
+	*f = *f.Mul(f.Dot(NewVec(3, 3, 3).Sub(f.Mul(2))))
 	n := p.Dot(NewVec(1, 57, 113))
 
+	var h [8]float64
+	seed := s.Seed + s.Evolve*s.Time
+	if s.noise != nil {
+		h = *s.noise.lookup(n, seed)
+	} else {
+		h = lattice_hashes(n, seed)
+	}
 	return lerpFloat64(lerpFloat64(
-		lerpFloat64(hash(n+0), hash(n+1), f.x),
-		lerpFloat64(hash(n+57), hash(n+58), f.x), f.y),
+		lerpFloat64(h[0], h[1], f.x),
+		lerpFloat64(h[2], h[3], f.x), f.y),
 		lerpFloat64(
-			lerpFloat64(hash(n+113), hash(n+114), f.x),
-			lerpFloat64(hash(n+170), hash(n+171), f.x), f.y), f.z)
+			lerpFloat64(h[4], h[5], f.x),
+			lerpFloat64(h[6], h[7], f.x), f.y), f.z)
+}
+
+// fractal_brownian_motion_periodic is the octave sum of fractal_brownian_motion repeating every s.NoisePeriod
+// units of the noise field p. The scale of each octave is rounded to give it a whole number of noise cells per
+// period, the noise of the octave wrapping around after that many.
+func fractal_brownian_motion_periodic(p *Vec, s *Scene) float64 {
+	scales := [4]float64{1, 2.32, 2.32 * 3.03, 2.32 * 3.03 * 2.61}
+	weights := [4]float64{0.5, 0.25, 0.125, 0.0625}
+	period := float64(s.NoisePeriod)
+	f := 0.0
+	for k, scale := range scales {
+		cells := math.Max(1, math.Round(period*scale))
+		f += weights[k] * noise_periodic(p.Mul(cells/period), cells, s)
+	}
+	return f / 0.9375
+}
+
+// noise_periodic is noise with the lattice wrapping around every period cells along each axis.
+func noise_periodic(x *Vec, period float64, s *Scene) float64 {
+	if s.GradientNoise {
+		return gradient_noise(x, period, s)
+	}
+	p := s.vecs.vec(Vec{x: math.Floor(x.x), y: math.Floor(x.y), z: math.Floor(x.z)})
+	f := s.vecs.vec(Vec{x: x.x - p.x, y: x.y - p.y, z: x.z - p.z})
+	if s.NoiseDims == 2 {
+		p.y, f.y = 0, 0
+	}
+	*f = *f.Mul(f.Dot(NewVec(3, 3, 3).Sub(f.Mul(2))))
+	wrap := func(c float64) float64 {
+		return c - period*math.Floor(c/period)
+	}
+	seed := s.Seed + s.Evolve*s.Time
+	k := math.Floor(seed) // hashed like lattice_hashes
+	w := seed - k
+	w = w * w * (3 - 2*w)
+	offset, next := 1e4*hash(k), 1e4*hash(k+1)
+	var h [8]float64
+	for c := range h { // in the order of lattice_hashes: x varies fastest, then y, then z
+		n := wrap(p.x+float64(c&1)) + 57*wrap(p.y+float64(c>>1&1)) + 113*wrap(p.z+float64(c>>2))
+		h[c] = hash(n + offset)
+		if w > 0 {
+			h[c] += (hash(n+next) - h[c]) * w
+		}
+	}
+	return lerpFloat64(lerpFloat64(
+		lerpFloat64(h[0], h[1], f.x),
+		lerpFloat64(h[2], h[3], f.x), f.y),
+		lerpFloat64(
+			lerpFloat64(h[4], h[5], f.x),
+			lerpFloat64(h[6], h[7], f.x), f.y), f.z)
+}
+
+// noise2 is the value noise of the plane (x,z), on the cells of the y=0 layer of the noise lattice.
+func noise2(x, z float64, s *Scene) float64 {
+	px, pz := math.Floor(x), math.Floor(z)
+	fx, fz := x-px, z-pz
+	fx, fz = fx*fx*(3-2*fx), fz*fz*(3-2*fz)
+	n := px + 113*pz
+
+	var h [8]float64
+	seed := s.Seed + s.Evolve*s.Time
+	if s.noise != nil {
+		h = *s.noise.lookup(n, seed)
+	} else {
+		h = lattice_hashes(n, seed)
+	}
+	return lerpFloat64(lerpFloat64(h[0], h[1], fx), lerpFloat64(h[4], h[5], fx), fz) // the corners at x, x+1, z+1 and x+1,z+1
+}
+
+// perlin_permutation is a fixed shuffle of 0..255, repeated so the nested lookups of gradient_noise never need
+// to wrap around it.
+var perlin_permutation = func() (p [512]int) {
+	for i := 0; i < 256; i++ {
+		p[i] = i
+	}
+	for i := 255; i > 0; i-- {
+		k := int(unit_hash(uint64(i)) * float64(i+1))
+		p[i], p[k] = p[k], p[i]
+	}
+	copy(p[256:], p[:256])
+	return p
+}()
+
+// perlin_gradient is the dot product of (x,y,z) with the gradient, one of the 12 edges of a cube, that the
+// hash h picks.
+func perlin_gradient(h int, x, y, z float64) float64 {
+	h &= 15
+	u, v := y, z
+	if h < 8 {
+		u = x
+	}
+	if h < 4 {
+		v = y
+	} else if h == 12 || h == 14 {
+		v = x
+	}
+	if h&1 != 0 {
+		u = -u
+	}
+	if h&2 != 0 {
+		v = -v
+	}
+	return u + v
+}
+
+// gradient_noise is Perlin's improved noise at x, remapped to about [0,1] like noise. The lattice corners get
+// pseudorandom gradients rather than values and the cells are blended with the quintic fade 6t^5-15t^4+10t^3,
+// whose second derivative is continuous, so unlike the value noise it shows no streaks along the lattice. With
+// a positive period the lattice wraps around every period cells; the seeds select and blend the lattices like
+// in lattice_hashes.
+func gradient_noise(x *Vec, period float64, s *Scene) float64 {
+	p := s.vecs.vec(Vec{x: math.Floor(x.x), y: math.Floor(x.y), z: math.Floor(x.z)})
+	f := s.vecs.vec(Vec{x: x.x - p.x, y: x.y - p.y, z: x.z - p.z})
+	if s.NoiseDims == 2 {
+		p.y, f.y = 0, 0
+	}
+	lattice := func(c float64) int {
+		if period > 0 {
+			c -= period * math.Floor(c/period)
+		}
+		return int(int64(c) & 255)
+	}
+	fade := func(t float64) float64 { return t * t * t * (t*(t*6-15) + 10) }
+	u, v, w := fade(f.x), fade(f.y), fade(f.z)
+	at := func(seed float64) float64 {
+		perm := &perlin_permutation
+		offset := int(int64(seed) & 255)
+		var g [8]float64
+		for c := range g { // x varies fastest, then y, then z
+			cx, cy, cz := float64(c&1), float64(c>>1&1), float64(c>>2)
+			h := perm[perm[perm[lattice(p.x+cx)+offset]+lattice(p.y+cy)]+lattice(p.z+cz)]
+			g[c] = perlin_gradient(h, f.x-cx, f.y-cy, f.z-cz)
+		}
+		return lerpFloat64(lerpFloat64(
+			lerpFloat64(g[0], g[1], u),
+			lerpFloat64(g[2], g[3], u), v),
+			lerpFloat64(
+				lerpFloat64(g[4], g[5], u),
+				lerpFloat64(g[6], g[7], u), v), w)
+	}
+	seed := s.Seed + s.Evolve*s.Time
+	k := math.Floor(seed)
+	n := at(k)
+	if t := seed - k; t > 0 {
+		n += (at(k+1) - n) * t * t * (3 - 2*t)
+	}
+	return 0.5 + 0.5*n
 }
 
-func rotate(v *Vec) *Vec {
-	return NewVec(NewVec(0.00, 0.80, 0.60).Dot(v), NewVec(-0.80, 0.36, -0.48).Dot(v), NewVec(-0.60, -0.48, 0.64).Dot(v))
+func rotate(v *Vec, m Mat3) *Vec {
+	return m.Apply(v)
 }
 
-func fractal_brownian_motion(x *Vec) float64 { // this is a bad noise function with lots of artifacts. TODO: find a better one
-	p := rotate(x)
+func fractal_brownian_motion(x *Vec, s *Scene) float64 { // this is a bad noise function with lots of artifacts. TODO: find a better one
+	const drift = 0.5 // speed of the flames rising through the noise field, in noise units per second
+	p := s.vecs.vec(*rotate(x.Add(NewVec(0, -drift*s.Time, 0)), s.NoiseRotation))
+	if s.NoisePeriod > 0 {
+		return fractal_brownian_motion_periodic(p, s)
+	}
 	f := 0.0
-	f += 0.5000 * noise(p)
-	p = p.Mul(2.32)
-	f += 0.2500 * noise(p)
-	p = p.Mul(3.03)
-	f += 0.1250 * noise(p)
-	p = p.Mul(2.61)
-	f += 0.0625 * noise(p)
+	f += 0.5000 * noise(p, s)
+	*p = *p.Mul(2.32)
+	f += 0.2500 * noise(p, s)
+	*p = *p.Mul(3.03)
+	f += 0.1250 * noise(p, s)
+	*p = *p.Mul(2.61)
+	f += 0.0625 * noise(p, s)
 	return f / 0.9375
 }
 
+// Palette maps d in [0,1], 0 on the outside of the explosion and 1 at its hottest, to a color.
+type Palette func(d float64) *Vec
+
+// GradientPalette maps [0,1] to colors interpolated between evenly spaced stops.
+type GradientPalette struct {
+	Stops  []*Vec // the colors at 0, 1/(len(Stops)-1), ..., 1
+	Smooth bool   // interpolate with a cubic spline instead of linearly, there are no creases at the stops
+}
+
+// Color returns the color of the palette at d, clamped to [0,1].
+func (g *GradientPalette) Color(d float64) *Vec {
+	segments := len(g.Stops) - 1
+	x := math.Max(0, math.Min(1, d)) * float64(segments)
+	k := min(int(x), segments-1)
+	t := x - float64(k)
+	if !g.Smooth {
+		return lerpVec(g.Stops[k], g.Stops[k+1], t)
+	}
+	// monotone cubic Hermite spline: the tangents at the stops are the harmonic means of the slopes around them,
+	// 0 at the extrema, so unlike Catmull-Rom the curve never overshoots the stops into negative or odd colors
+	tangent := func(prev, next float64) float64 {
+		if prev*next <= 0 {
+			return 0
+		}
+		return 2 * prev * next / (prev + next)
+	}
+	channel := func(c func(v *Vec) float64) float64 {
+		y1, y2 := c(g.Stops[k]), c(g.Stops[k+1])
+		m1, m2 := y2-y1, y2-y1
+		if k > 0 {
+			m1 = tangent(y1-c(g.Stops[k-1]), y2-y1)
+		}
+		if k+2 <= segments {
+			m2 = tangent(y2-y1, c(g.Stops[k+2])-y2)
+		}
+		return (2*t*t*t-3*t*t+1)*y1 + (t*t*t-2*t*t+t)*m1 + (3*t*t-2*t*t*t)*y2 + (t*t*t-t*t)*m2
+	}
+	return NewVec(channel(func(v *Vec) float64 { return v.x }), channel(func(v *Vec) float64 { return v.y }), channel(func(v *Vec) float64 { return v.z }))
+}
+
+// fire_gradient is the gradient of the original render: gray, darkgray, red, orange, yellow.
+var fire_gradient = GradientPalette{Stops: []*Vec{
+	NewVec(0.4, 0.4, 0.4),
+	NewVec(0.2, 0.2, 0.2),
+	NewVec(1.0, 0.0, 0.0),
+	NewVec(1.0, 0.6, 0.0),
+	NewVec(1.7, 1.3, 1.0), // note that the color is "hot", i.e. has components >1
+}}
+
+// ice_gradient fades from a cold gray through deep and pale blue to a bluish white.
+var ice_gradient = GradientPalette{Stops: []*Vec{
+	NewVec(0.35, 0.4, 0.45),
+	NewVec(0.1, 0.12, 0.2),
+	NewVec(0.0, 0.2, 1.0),
+	NewVec(0.3, 0.8, 1.0),
+	NewVec(1.1, 1.4, 1.7),
+}}
+
+// nebula_gradient goes from a dusty violet through purple and magenta to a hot pinkish white.
+var nebula_gradient = GradientPalette{Stops: []*Vec{
+	NewVec(0.3, 0.25, 0.4),
+	NewVec(0.1, 0.05, 0.2),
+	NewVec(0.6, 0.0, 0.8),
+	NewVec(1.0, 0.2, 0.6),
+	NewVec(1.5, 1.1, 1.6),
+}}
+
+// Palettes maps the -palette names to their gradients.
+var Palettes = map[string]*GradientPalette{
+	"fire":   &fire_gradient,
+	"ice":    &ice_gradient,
+	"nebula": &nebula_gradient,
+}
+
 func palette_fire(d float64) *Vec { // simple linear gradent yellow-orange-red-darkgray-gray. d is supposed to vary from 0 to 1
-	var (
-		yellow   = NewVec(1.7, 1.3, 1.0) // note that the color is "hot", i.e. has components >1
-		orange   = NewVec(1.0, 0.6, 0.0)
-		red      = NewVec(1.0, 0.0, 0.0)
-		darkgray = NewVec(0.2, 0.2, 0.2)
-		gray     = NewVec(0.4, 0.4, 0.4)
-	)
+	return fire_gradient.Color(d)
+}
+
+// palette_fire_smooth is palette_fire interpolating the colors with a spline.
+func palette_fire_smooth(d float64) *Vec {
+	g := fire_gradient
+	g.Smooth = true
+	return g.Color(d)
+}
+
+// palette_ice is the linear gradient of ice_gradient, a Scene.Palette for a frozen blast.
+func palette_ice(d float64) *Vec {
+	return ice_gradient.Color(d)
+}
+
+// palette_nebula is the linear gradient of nebula_gradient.
+func palette_nebula(d float64) *Vec {
+	return nebula_gradient.Color(d)
+}
+
+// palette_phase shifts the palette lookup d by phase, wrapping around the ends of the gradient.
+func palette_phase(d, phase float64) float64 {
+	if phase == 0 {
+		return d
+	}
+	x := math.Max(0, math.Min(1, d)) + phase
+	return x - math.Floor(x)
+}
+
+func background_flat(dir *Vec) *Vec {
+	return NewVec(0.2, 0.7, 0.8)
+}
+
+func background_stars(dir *Vec) *Vec { // the directions are bucketed into tiny cells and a few cells are hashed into stars; it only depends on dir, so the stars are stable across frames
+	const density = 400.0 // cells per unit of direction
+	cell := NewVec(math.Floor(dir.x*density), math.Floor(dir.y*density), math.Floor(dir.z*density))
+	n := cell.Dot(NewVec(12.9898, 78.233, 37.719)) // the lattice constants of noise() line up into visible streaks here
+	if hash(n) < 0.998 {
+		return NewVec(0, 0, 0.02) // the night sky
+	}
+	brightness := 0.3 + 0.7*hash(n+1)
+	return NewVec(brightness, brightness, brightness*(0.8+0.4*hash(n+2))) // slightly blue or yellow stars
+}
+
+// Backgrounds maps the -bg names to the colors of the rays missing the explosion.
+var Backgrounds = map[string]func(dir *Vec) *Vec{
+	"flat":  background_flat,
+	"stars": background_stars,
+}
+
+func signed_distance(p *Vec, s *Scene) float64 { // this function defines the implicit surface we render
+	if s.SDF == nil && (s.Radius == 0 || s.Radius == sphere_radius) {
+		// called directly rather than through shape, the fireball lets q stay on the stack: passed to a func
+		// value it would escape, and this runs for every step of every ray
+		q := p.Sub(s.Center)
+		return sdf_fireball(q) - noise_displacement(q, s)
+	}
+	// not s.vecs.vec: q escapes to the SDF, and inlined the &v of vec would then go to the heap even with a pool
+	var q *Vec
+	if s.vecs != nil {
+		q = s.vecs.get(*p.Sub(s.Center))
+	} else {
+		q = p.Sub(s.Center)
+	}
+	return shape(s)(q) - noise_displacement(q, s)
+}
+
+// noise_displacement is how far the noise pushes the surface of the shape at p, relative to the center of the
+// explosion: negative, towards the center.
+func noise_displacement(p *Vec, s *Scene) float64 {
+	frequency, amplitude := NoiseScale(s)
+	return -fractal_brownian_motion(p.Mul(frequency), s) * amplitude
+}
+
+// NoiseScale returns the frequency and the amplitude of the noise of the scene, noise_frequency and
+// noise_amplitude unless the scene sets them.
+func NoiseScale(s *Scene) (frequency, amplitude float64) {
+	frequency, amplitude = noise_frequency, noise_amplitude
+	if s.NoiseFreq != 0 {
+		frequency = s.NoiseFreq
+	}
+	if s.NoiseAmp != 0 {
+		amplitude = s.NoiseAmp
+	}
+	return frequency, amplitude
+}
+
+// InsideSurface reports whether the point p is inside the displaced surface of the explosion of the scene, where
+// its signed distance is negative.
+func InsideSurface(p *Vec, s *Scene) bool {
+	return signed_distance(p, s) < 0
+}
+
+// shape returns the SDF of the scene.
+func shape(s *Scene) SDF {
+	sdf := s.SDF
+	if sdf == nil {
+		sdf = sdf_fireball
+	}
+	if s.Radius == 0 || s.Radius == sphere_radius {
+		return sdf
+	}
+	k := sphere_radius / s.Radius
+	return func(p *Vec) float64 { return sdf(p.Mul(k)) / k } // a uniform scaling keeps the distances exact
+}
+
+// SceneRadius is the radius of the sphere about the center the explosion fits in, s.Radius or sphere_radius.
+// The noise only carves the shape inwards, so it never reaches out of the sphere whatever its amplitude.
+func SceneRadius(s *Scene) float64 {
+	if s.Radius == 0 {
+		return sphere_radius
+	}
+	return s.Radius
+}
 
-	x := math.Max(0, math.Min(1, d))
-	if x < .25 {
-		return lerpVec(gray, darkgray, x*4)
-	} else if x < .5 {
-		return lerpVec(darkgray, red, x*4-1)
-	} else if x < .75 {
-		return lerpVec(red, orange, x*4-2)
+const max_march_steps = 128
+
+// sphere_trace marches along the ray starting at orig in the unit direction dir and reports whether it enters the
+// surface. On a hit pos is the point found inside the surface, less than a step past it. Rays missing the
+// bounding sphere are discarded without marching unless s.NoDiscard is set; pos is then left untouched.
+func sphere_trace(orig, dir, pos *Vec, s *Scene) bool {
+	t, hit := sphere_trace_distance(orig, dir, s)
+	if hit {
+		*pos = *orig.MulAdd(dir, t)
 	}
-	return lerpVec(orange, yellow, x*4-3)
+	return hit
 }
 
-func signed_distance(p *Vec) float64 { // this function defines the implicit surface we render
-	displacement := -fractal_brownian_motion(p.Mul(3.4)) * noise_amplitude
-	return p.Norm() - (sphere_radius + displacement)
+// sphere_trace_distance returns the distance along dir from orig to the first march point inside the surface,
+// false when the ray misses it, for the effects depending on the depth.
+func sphere_trace_distance(orig, dir *Vec, s *Scene) (float64, bool) {
+	var pos Vec
+	hit, t, _ := sphere_trace_steps(orig, dir, &pos, s)
+	return t, hit
 }
 
-func sphere_trace(orig, dir, pos *Vec) bool { // Notice the early discard; in fact I know that the noise() function produces non-negative values,
-	if orig.Dot(orig)-math.Pow(orig.Dot(dir), 2) > math.Pow(sphere_radius, 2) {
-		return false // thus all the explosion fits in the sphere. Thus this early discard is a conservative check.
+// sphere_trace_steps is sphere_trace also returning the distance marched along dir and the number of distance
+// evaluations the march took, 0 for the early discarded rays and max_march_steps for the rays that never reached
+// the surface. On a hit pos is the march point itself, the shading uses it rather than recomputing it from the
+// distance.
+func sphere_trace_steps(orig, dir, pos *Vec, s *Scene) (bool, float64, int) { // Notice the early discard; in fact I know that the noise() function produces non-negative values,
+	oc := s.vecs.vec(*orig.Sub(s.Center))
+	if !s.NoDiscard && oc.Dot(oc)-math.Pow(oc.Dot(dir), 2) > math.Pow(SceneRadius(s), 2) {
+		return false, 0, 0 // thus all the explosion fits in the sphere. Thus this early discard is a conservative check.
 	}
 	// It is not necessary, just a small speed-up
 	*pos = *orig
-	for i := 0; i < 128; i++ {
-		d := signed_distance(pos)
+	t := 0.0
+	for i := 0; i < max_march_steps; i++ {
+		d := signed_distance(pos, s)
 		if d < 0 {
-			return true
+			return true, t, i + 1
 		}
-		*pos = *(pos.Add(dir.Mul(math.Max(d*0.1, .01)))) // note that the step depends on the current distance, if we are far from the surface, we can do big steps
+		step := math.Max(d*0.1, .01) // note that the step depends on the current distance, if we are far from the surface, we can do big steps
+		*pos = *(pos.MulAdd(dir, step))
+		t += step
 	}
-	return false
+	return false, t, max_march_steps
 }
 
-func distance_field_normal(pos *Vec) *Vec { // simple finite differences, very sensitive to the choice of the eps constant
+func distance_field_normal(pos *Vec, s *Scene) *Vec { // simple finite differences, very sensitive to the choice of the eps constant
 	const eps = 0.1
-	d := signed_distance(pos)
-	nx := signed_distance(NewVec(eps, 0, 0).Add(pos)) - d
-	ny := signed_distance(NewVec(0, eps, 0).Add(pos)) - d
-	nz := signed_distance(NewVec(0, 0, eps).Add(pos)) - d
+	d := signed_distance(pos, s)
+	nx := signed_distance(NewVec(eps, 0, 0).Add(pos), s) - d
+	ny := signed_distance(NewVec(0, eps, 0).Add(pos), s) - d
+	nz := signed_distance(NewVec(0, 0, eps).Add(pos), s) - d
 	return NewVec(nx, ny, nz).Normalize(1)
 }
 
-func main() {
-	const (
-		width  = 640         // image width
-		height = 480         // image height
-		fov    = math.Pi / 3 // field of view angle
-	)
+// shape_normal is the normal of the shape of the scene at pos ignoring the noise displacement, the radial
+// direction for the fireball, by central differences small enough for the SDFs being smooth.
+func shape_normal(pos *Vec, s *Scene) *Vec {
+	const eps = 1e-4
+	sdf, p := shape(s), pos.Sub(s.Center)
+	nx := sdf(NewVec(eps, 0, 0).Add(p)) - sdf(NewVec(-eps, 0, 0).Add(p))
+	ny := sdf(NewVec(0, eps, 0).Add(p)) - sdf(NewVec(0, -eps, 0).Add(p))
+	nz := sdf(NewVec(0, 0, eps).Add(p)) - sdf(NewVec(0, 0, -eps).Add(p))
+	return NewVec(nx, ny, nz).Normalize(1)
+}
 
-	framebuffer := [width * height]*Vec{}
+// surface_normal is the shading normal at pos, the normal of the displaced surface blended towards the one of the
+// bare shape by s.SmoothNormal, for a less busy shading of the noise.
+func surface_normal(pos *Vec, s *Scene) *Vec {
+	n := distance_field_normal(pos, s)
+	if k := s.SmoothNormal; k > 0 {
+		if b := lerpVec(n, shape_normal(pos, s), k); b.Norm() > 0 {
+			n = b.Normalize(1)
+		}
+	}
+	return n
+}
 
-	nproc := runtime.NumCPU()
-	c := height / nproc
-	var wg sync.WaitGroup
-	for I := 0; I < nproc; I++ {
-		min := I * c
-		max := (I + 1) * c
-		if max > height {
-			max = (I * c) + height%c
+// RenderConfig holds the parameters of a single render.
+type RenderConfig struct {
+	Scene Scene
+
+	Width, Height int     // image size in pixels
+	FOV           float64 // field of view angle, in radians
+	Zoom          float64 // magnification around the image center on top of the FOV, 0 means 1
+	PixelAspect   float64 // width over height of the pixels of the perspective projection for non-square pixel displays, 0 means 1; FOV stays vertical
+	Projection    Projection
+	HFOV          float64 // horizontal field of view of ProjectionCylindrical, in radians, up to 2π for a full turn
+	TileSize      int     // the image is split into TileSize x TileSize tiles handed out to the workers
+	NoiseCache    bool    // give each worker a cache of the noise lattice hashes, it doesn't change the image
+	VecPool       bool    // recycle the temporary vectors of the noise, of the march and of a custom SDF through vec_pool, it doesn't change the image
+	Workers       int     // number of goroutines rendering the tiles, one per CPU when 0; it doesn't change the image
+
+	// OriginBottomLeft stores the image in the framebuffers from the bottom row up instead of from the top
+	// row down, for the libraries and file formats starting at the bottom left corner. The default,
+	// top-left, is the order of the PPM rows.
+	OriginBottomLeft bool
+
+	rays      *rayGrid   // the ray directions of the pixels when they are computed once for all the frames of a sequence
+	frames    *framePool // where the frames of a sequence come from, and are returned once written out, when set
+	histogram *histogram // where forEachPixel merges the histograms the workers fill in their copies, when set
+
+	// Checkpoint, when set, saves the pixels of the first pass of RenderContext as the tiles are completed, or
+	// resumes from the saved ones. Only a single RenderContext can use it, not the stereo or motion blur ones.
+	Checkpoint *Checkpoint
+	checkpoint *Checkpoint // Checkpoint during the first pass, where forEachPixel records the tiles
+
+	// Progress, when set, counts the pixels of every pass of forEachPixel, for reporting while rendering.
+	Progress *Progress
+
+	AA          AAMode     // antialiasing strategy
+	AASamples   int        // the antialiased pixels are sampled by a AASamples x AASamples grid of rays
+	AAThreshold float64    // difference with a neighbor above which a pixel is refined: of luminance for AAAdaptive, of depth for AADepth
+	CheapAA     bool       // light the antialiased pixels once at their center instead of at every sample
+	BlueNoise   *BlueNoise // if set, jitters the antialiasing samples inside their cells of the grid
+	Jitter      bool       // without BlueNoise, jitters the antialiasing samples by white noise of JitterSeed
+	JitterSeed  uint64
+
+	// SSAA renders the whole image SSAA times larger in both dimensions and averages it down by SSAA x SSAA
+	// blocks, 0 or 1 to disable it. This smooths the interior gradients as well as the edges but the render
+	// costs SSAA² times as much time and memory: about 40 bytes per pixel, so 118MB for 640x480 at SSAA 8.
+	SSAA int
+
+	MotionBlur int     // number of renders at evenly spaced times of the shutter interval averaged together, 0 or 1 for no blur
+	Shutter    float64 // duration in seconds of the shutter interval starting at Scene.Time
+	FPS        float64 // frame rate of the sequences, 24 when 0
+
+	Background func(dir *Vec) *Vec // color of the rays that miss the explosion, background_flat when nil
+	Backdrop   image.Image         // if set, stretched over the image behind the explosion and composited over Background
+	Mask       image.Image         // if set, stretched over the image, only the rays through its light pixels are traced
+
+	// CompositeOver, if set, is an image of the size of the render the explosion is composited over: each pixel
+	// is the source-over blend αF + (1-α)B of the explosion F onto the pixel B under it, the alpha α being the
+	// fraction of the samples of the pixel hitting the explosion or the floor. The colors of the explosion are
+	// straight, those of the image premultiplied by its alpha like in image.Image, its transparent parts showing
+	// Background. Only the antialiased pixels get an alpha between 0 and 1. It excludes Backdrop.
+	CompositeOver image.Image
+
+	Debug DebugMode // replaces the shading by a diagnostic visualization
+
+	Stereo StereoMode // renders a view for each eye
+	IPD    float64    // distance between the eyes of the stereo views
+}
+
+type tile struct {
+	x0, y0, x1, y1 int // the tile covers the pixels [x0,x1) x [y0,y1)
+}
+
+func splitTiles(width, height, size int) []tile {
+	var tiles []tile
+	for y := 0; y < height; y += size {
+		for x := 0; x < width; x += size {
+			t := tile{x0: x, y0: y, x1: x + size, y1: y + size}
+			if t.x1 > width {
+				t.x1 = width
+			}
+			if t.y1 > height {
+				t.y1 = height
+			}
+			tiles = append(tiles, t)
+		}
+	}
+	return tiles
+}
+
+// camera_ray returns the ray through the point (x,y) of the image plane, in pixel units from the top left corner.
+func camera_ray(cfg *RenderConfig, x, y float64) (orig, dir *Vec) {
+	if r := cfg.Scene.Roll; r != 0 {
+		orig, dir = camera_ray_unrolled(cfg, x, y)
+		sin, cos := math.Sincos(r)
+		return orig, NewVec(dir.x*cos-dir.y*sin, dir.x*sin+dir.y*cos, dir.z)
+	}
+	return camera_ray_unrolled(cfg, x, y)
+}
+
+// camera_ray_unrolled is camera_ray ignoring the roll of the camera.
+func camera_ray_unrolled(cfg *RenderConfig, x, y float64) (orig, dir *Vec) {
+	if cfg.Projection == ProjectionCylindrical {
+		return cfg.Scene.Camera, cylindrical_ray_dir(cfg, x, y)
+	}
+	width, height := float64(cfg.Width), float64(cfg.Height)
+	// the image plane is centered on the view axis with its x axis pointing right and its y axis pointing up,
+	// while the image rows go down from the top
+	dir_x := x - width/2.0
+	if cfg.PixelAspect != 0 {
+		dir_x *= cfg.PixelAspect // the columns of wide pixels are further apart on the image plane
+	}
+	dir_y := height/2.0 - y
+	dir_z := -height / (2.0 * math.Tan(cfg.FOV/2.0))
+	if cfg.Zoom != 0 {
+		dir_z *= cfg.Zoom // pushing the image plane away narrows the spread of the rays
+	}
+	return cfg.Scene.Camera, NewVec(dir_x, dir_y, dir_z).Normalize(1)
+}
+
+// camera_right is the unit vector pointing to the right of the image.
+func camera_right(s *Scene) *Vec {
+	if s.Roll != 0 {
+		sin, cos := math.Sincos(s.Roll)
+		return NewVec(cos, sin, 0)
+	}
+	return NewVec(1, 0, 0)
+}
+
+// surface_color is the unlit palette color of the surface point hit.
+func surface_color(cfg *RenderConfig, hit *Vec) *Vec {
+	_, amplitude := NoiseScale(&cfg.Scene)
+	noise_level := -shape(&cfg.Scene)(hit.Sub(cfg.Scene.Center)) / amplitude
+	return palette_color(&cfg.Scene, (-.2+noise_level)*2)
+}
+
+// palette_color is the color of the palette of the scene at the distance d into the fireball, 0 at the surface
+// of the sphere and 1 at half the noise amplitude below it.
+func palette_color(s *Scene, d float64) *Vec {
+	if g := s.PaletteGamma; g != 0 && g != 1 {
+		d = math.Pow(math.Max(0, math.Min(1, d)), g)
+	}
+	if s.InvertPalette {
+		d = 1 - math.Max(0, math.Min(1, d))
+	}
+	d = palette_phase(d, s.PaletteCycle*s.Time)
+	if n := float64(s.PaletteBands); n > 0 {
+		d = (math.Min(math.Floor(math.Max(0, d)*n), n-1) + 0.5) / n
+	}
+	if s.Palette != nil {
+		return s.Palette(d)
+	}
+	if s.SmoothPalette {
+		return palette_fire_smooth(d)
+	}
+	return palette_fire(d)
+}
+
+// PaletteStrip renders the palette of the scene as a width x height strip, the column x showing the color at
+// (x+0.5)/width.
+func PaletteStrip(s *Scene, width, height int) *Frame {
+	f := new_frame(width, height)
+	for i := 0; i < width; i++ {
+		c := palette_color(s, (float64(i)+0.5)/float64(width))
+		for j := 0; j < height; j++ {
+			f.Color[i+j*width] = c.Clone() // no cells sharing a vector
+		}
+	}
+	return f
+}
+
+// light_intensity is the lighting of the surface point hit. It is the expensive part of the shading.
+func light_intensity(cfg *RenderConfig, hit *Vec) float64 {
+	return illumination(cfg, hit, surface_normal(hit, &cfg.Scene))
+}
+
+// light_position is the position at the time of the scene of the point light placed at l: l turned around the
+// y axis by LightOrbit turns per second.
+func light_position(s *Scene, l *Vec) *Vec {
+	if s.LightOrbit == 0 {
+		return l
+	}
+	sin, cos := math.Sincos(2 * math.Pi * s.LightOrbit * s.Time)
+	return NewVec(l.x*cos+l.z*sin, l.y, l.z*cos-l.x*sin)
+}
+
+// illumination is the lighting of a surface point p of normal n by all the lights of the scene. The
+// contributions of the lights are clamped to 0 and added up, the ambient floor applies to the sum once.
+func illumination(cfg *RenderConfig, p, n *Vec) float64 {
+	intensity := 0.0
+	for _, l := range cfg.Scene.Lights {
+		lp := light_position(&cfg.Scene, l)
+		light := (lp.Sub(p)).Normalize(1).Dot(n)
+		if light <= 0 {
+			continue
+		}
+		if cfg.Scene.Shadow > 0 {
+			light *= area_shadow(p.MulAdd(n, shadow_bias), lp, &cfg.Scene)
+		}
+		intensity += light
+	}
+	for i := range cfg.Scene.SpotLights {
+		intensity += cfg.Scene.SpotLights[i].intensity(p, n)
+	}
+	return math.Max(cfg.Scene.Ambient, intensity)
+}
+
+// shadow_bias is how far along the normal the shadow rays start above the surface point being lit. The hits of
+// sphere_trace are slightly inside the surface, so without it the points would shadow themselves.
+const shadow_bias = 0.05
+
+// shadow is the fraction of the light at lp reaching p: 0 if the ray towards the light re-enters the explosion,
+// else the smallest s.Shadow*d/t along the ray, d being the distance to the surface at t along it, so the rays
+// grazing the explosion get a penumbra, sharper the larger s.Shadow. The ray is marched like in
+// sphere_trace_steps, only where it crosses the bounding sphere unless s.NoDiscard.
+func shadow(p, lp *Vec, s *Scene) float64 {
+	dir := lp.Sub(p)
+	t0, t1 := 0.0, dir.Norm()
+	dir = dir.Mul(1 / t1)
+	if !s.NoDiscard {
+		oc := p.Sub(s.Center)
+		b := oc.Dot(dir)
+		r := SceneRadius(s)
+		disc := b*b - oc.Dot(oc) + r*r
+		if disc <= 0 {
+			return 1
+		}
+		t0, t1 = math.Max(t0, -b-math.Sqrt(disc)), math.Min(t1, -b+math.Sqrt(disc))
+	}
+	light := 1.0
+	t := math.Max(t0, 1e-3)
+	for i := 0; i < max_march_steps && t < t1; i++ {
+		d := signed_distance(p.MulAdd(dir, t), s)
+		if d < 0 {
+			return 0
+		}
+		light = math.Min(light, s.Shadow*d/t)
+		t += math.Max(d*0.1, .01)
+	}
+	return light
+}
+
+// light_samples is the default number of shadow rays towards the lights of positive Scene.LightSize.
+const light_samples = 16
+
+// area_shadow is the fraction of the light at lp reaching p when the light is a sphere of radius s.LightSize:
+// the average of the shadow towards s.LightSamples points jittered in the sphere, so the shadows get a penumbra
+// where only part of the light is hidden. The points are a function of p, so the image doesn't depend on the
+// order the workers render the pixels in. It is the shadow towards lp itself when s.LightSize is 0.
+func area_shadow(p, lp *Vec, s *Scene) float64 {
+	if s.LightSize <= 0 {
+		return shadow(p, lp, s)
+	}
+	n := s.LightSamples
+	if n <= 0 {
+		n = light_samples
+	}
+	h := math.Float64bits(p.x)*0x9e3779b97f4a7c15 ^ math.Float64bits(p.y)*0xc2b2ae3d27d4eb4f ^ math.Float64bits(p.z)*0xd6e8feb86659fd93
+	light := 0.0
+	for k := 0; k < n; k++ {
+		hk := h ^ uint64(k+1)*0xa0761d6478bd642f
+		z, phi := 2*unit_hash(hk)-1, 2*math.Pi*unit_hash(hk^0xe7037ed1a0b428db)
+		r := s.LightSize * math.Cbrt(unit_hash(hk^0x8ebc6af09c88c6e3)) // uniform in the volume of the sphere
+		sin, cos := math.Sincos(phi)
+		rxy := r * math.Sqrt(1-z*z)
+		light += shadow(p, lp.Add(NewVec(rxy*cos, rxy*sin, r*z)), s)
+	}
+	return light / float64(n)
+}
+
+// floor_color is the lit color of the floor where the ray from orig of direction dir meets it and its distance
+// along the ray, false if there's no floor or the ray doesn't cross it.
+func floor_color(cfg *RenderConfig, orig, dir *Vec) (*Vec, float64, bool) {
+	fl := cfg.Scene.Floor
+	if fl == nil {
+		return nil, 0, false
+	}
+	t, ok := fl.intersect(orig, dir)
+	if !ok {
+		return nil, 0, false
+	}
+	p := orig.MulAdd(dir, t)
+	return fl.color(p).Mul(illumination(cfg, p, NewVec(0, 1, 0))), t, true
+}
+
+// background_color is the color of the ray of direction dir through the point (x,y) of the image plane that missed the explosion.
+func background_color(cfg *RenderConfig, x, y float64, dir *Vec) *Vec {
+	bg := background_flat
+	if cfg.Background != nil {
+		bg = cfg.Background
+	}
+	if o := cfg.CompositeOver; o != nil { // the pixel under the sample, so the samples of a pixel all blend onto the same color
+		b := o.Bounds()
+		return over_background(o.At(b.Min.X+min(int(x), b.Dx()-1), b.Min.Y+min(int(y), b.Dy()-1)), bg, dir)
+	}
+	if cfg.Backdrop == nil {
+		return bg(dir)
+	}
+	b := cfg.Backdrop.Bounds()
+	px := b.Min.X + int(math.Min(x/float64(cfg.Width), 1)*float64(b.Dx()-1)+0.5)
+	py := b.Min.Y + int(math.Min(y/float64(cfg.Height), 1)*float64(b.Dy()-1)+0.5)
+	return over_background(cfg.Backdrop.At(px, py), bg, dir)
+}
+
+// over_background is the color of the image pixel p composited over the background bg in the direction dir.
+func over_background(p color.Color, bg func(dir *Vec) *Vec, dir *Vec) *Vec {
+	r, g, bl, a := p.RGBA() // alpha premultiplied 16 bit channels
+	c := NewVec(float64(r)/0xffff, float64(g)/0xffff, float64(bl)/0xffff)
+	if a == 0xffff {
+		return c
+	}
+	return c.MulAdd(bg(dir), 1-float64(a)/0xffff)
+}
+
+// masked_out reports whether cfg.Mask, stretched over the image, is dark at the point (x,y) of the image plane.
+func masked_out(cfg *RenderConfig, x, y float64) bool {
+	if cfg.Mask == nil {
+		return false
+	}
+	b := cfg.Mask.Bounds()
+	px := b.Min.X + min(int(x/float64(cfg.Width)*float64(b.Dx())), b.Dx()-1)
+	py := b.Min.Y + min(int(y/float64(cfg.Height)*float64(b.Dy())), b.Dy()-1)
+	return color.GrayModel.Convert(cfg.Mask.At(px, py)).(color.Gray).Y < 128
+}
+
+// renderSample returns the color seen through the point (x,y) of the image plane, in pixel units from the top left
+// corner, and the distance from the camera to the surface, +Inf for the background.
+func renderSample(cfg *RenderConfig, x, y float64) (*Vec, float64) {
+	orig, dir := camera_ray(cfg, x, y)
+	return shade_ray(cfg, orig, dir, x, y)
+}
+
+// shade_ray is renderSample for the camera ray from orig of direction dir.
+func shade_ray(cfg *RenderConfig, orig, dir *Vec, x, y float64) (*Vec, float64) {
+	if masked_out(cfg, x, y) {
+		return background_color(cfg, x, y, dir), math.Inf(1)
+	}
+	var hit Vec
+	if cfg.Debug == DebugSteps {
+		ok, t, steps := sphere_trace_steps(orig, dir, &hit, &cfg.Scene)
+		if !ok {
+			return NewVec(1, 1, 1), math.Inf(1) // white, marched to the end or discarded by the bounding sphere alike
+		}
+		return debug_steps_hit(steps), t
+	}
+	ok, t, _ := sphere_trace_steps(orig, dir, &hit, &cfg.Scene)
+	var c *Vec
+	d := math.Inf(1)
+	switch fc, ft, floor := floor_color(cfg, orig, dir); {
+	case floor && (!ok || ft < t):
+		c, d = fc, ft
+	case ok:
+		c, d = surface_color(cfg, &hit).Mul(light_intensity(cfg, &hit)), t
+	default:
+		c = background_color(cfg, x, y, dir)
+	}
+	c = apply_fog(&cfg.Scene, orig, dir, c, d)
+	cfg.Scene.vecs.release()
+	return c, d
+}
+
+// renderPixel samples the center of the pixel (i,j) of the framebuffer.
+func renderPixel(cfg *RenderConfig, i, j int) (*Vec, float64) {
+	x, y := float64(i)+0.5, float64(screen_row(cfg, j))+0.5
+	if cfg.rays != nil {
+		return shade_ray(cfg, cfg.Scene.Camera, cfg.rays.dirs[i+j*cfg.Width], x, y)
+	}
+	return renderSample(cfg, x, y)
+}
+
+// rayGrid holds the directions of the camera rays through the pixel centers, in the framebuffer order.
+type rayGrid struct {
+	dirs []*Vec
+}
+
+// new_ray_grid traces the directions for the image geometry of cfg, only valid for the configs sharing it.
+func new_ray_grid(cfg *RenderConfig) *rayGrid {
+	g := &rayGrid{dirs: make([]*Vec, cfg.Width*cfg.Height)}
+	for j := 0; j < cfg.Height; j++ {
+		for i := 0; i < cfg.Width; i++ {
+			_, g.dirs[i+j*cfg.Width] = camera_ray(cfg, float64(i)+0.5, float64(screen_row(cfg, j))+0.5)
+		}
+	}
+	return g
+}
+
+// screen_row is the row of the image, counted from the top, stored in the row j of the framebuffer.
+func screen_row(cfg *RenderConfig, j int) int {
+	if cfg.OriginBottomLeft {
+		return cfg.Height - 1 - j
+	}
+	return j
+}
+
+// Frame is a rendered image along with the per-pixel data the post-processing passes need.
+// The buffers are stored row by row from the top left corner, or the bottom left one with RenderConfig.OriginBottomLeft.
+type Frame struct {
+	Width, Height int
+	Color         []*Vec    // a vector of its own for every pixel, which the post-processing replaces rather than modifies
+	Depth         []float64 // distance from the camera to the surface, +Inf where the ray missed
+
+	Stats Stats
+}
+
+// Clone returns a copy of the frame that can be modified without changing f, down to the color vectors.
+func (f *Frame) Clone() *Frame {
+	c := *f
+	c.Color = make([]*Vec, len(f.Color))
+	for i, v := range f.Color {
+		if v != nil {
+			c.Color[i] = v.Clone()
+		}
+	}
+	c.Depth = append([]float64(nil), f.Depth...)
+	return &c
+}
+
+// Stats are the counters gathered during a render.
+type Stats struct {
+	Refined int // pixels supersampled by the adaptive antialiasing
+
+	luminance histogram // of the pixels before the antialiasing refines them
+}
+
+// Exposure returns the factor scaling the colors of the frame to a well exposed average luminance.
+func (s *Stats) Exposure() float64 {
+	return s.luminance.exposure()
+}
+
+func (s *Stats) merge(o *Stats) {
+	s.Refined += o.Refined
+	s.luminance.merge(&o.luminance)
+}
+
+// Render traces the explosion and returns the framebuffer, row by row from the top left corner unless
+// cfg.OriginBottomLeft is set.
+func Render(cfg RenderConfig) ([]*Vec, error) {
+	f, err := RenderFrame(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return f.Color, nil
+}
+
+// RenderFrame is like Render but also returns the depth buffer.
+func RenderFrame(cfg RenderConfig) (*Frame, error) {
+	return RenderContext(context.Background(), cfg)
+}
+
+// RenderPNGTo renders the explosion and encodes it as a PNG straight to w, without buffering the encoded image.
+func RenderPNGTo(w io.Writer, cfg RenderConfig) error {
+	f, err := RenderFrame(cfg)
+	if err != nil {
+		return err
+	}
+	return WritePNG(w, f.Color, f.Width, f.Height)
+}
+
+// RenderPPMTo is RenderPNGTo for the binary PPM format.
+func RenderPPMTo(w io.Writer, cfg RenderConfig) error {
+	f, err := RenderFrame(cfg)
+	if err != nil {
+		return err
+	}
+	return WritePPM(w, f.Color, f.Width, f.Height)
+}
+
+func new_frame(width, height int) *Frame {
+	return &Frame{
+		Width:  width,
+		Height: height,
+		Color:  make([]*Vec, width*height),
+		Depth:  make([]float64, width*height),
+	}
+}
+
+// framePool recycles the frames of a sequence, so a long animation doesn't allocate new framebuffers for every
+// frame. It is safe for concurrent use, the frames being put back by the goroutines writing them out.
+type framePool struct {
+	free chan *Frame
+}
+
+// new_frame_pool returns a pool keeping up to n frames.
+func new_frame_pool(n int) *framePool {
+	return &framePool{free: make(chan *Frame, n)}
+}
+
+// get returns a frame of the given size with no pixel rendered, reusing a free one when there is one. It
+// allocates a new frame on a nil pool.
+func (p *framePool) get(width, height int) *Frame {
+	if p != nil {
+		select {
+		case f := <-p.free:
+			if f.Width == width && f.Height == height {
+				clear(f.Color)
+				f.Stats = Stats{}
+				return f
+			}
+		default:
+		}
+	}
+	return new_frame(width, height)
+}
+
+// put returns f to the pool for reuse, f mustn't be used afterwards. When the pool is full or nil, f is left
+// to the garbage collector.
+func (p *framePool) put(f *Frame) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.free <- f:
+	default:
+	}
+}
+
+// RenderContext is RenderFrame stopping early when ctx is done. The workers check ctx at the end of every row of
+// their tiles, so it returns about the time of a row after ctx is done, with the error of ctx, like
+// context.Canceled, and the partial frame: the pixels not rendered yet are filled with the background, and the
+// ones an interrupted antialiasing pass didn't get to are left unrefined. An invalid cfg is reported first,
+// without a frame.
+func RenderContext(ctx context.Context, cfg RenderConfig) (*Frame, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Stereo != StereoNone {
+		return render_stereo(ctx, cfg)
+	}
+	if cfg.MotionBlur > 1 {
+		return render_motion_blur(ctx, cfg)
+	}
+	if cfg.SSAA > 1 {
+		n := cfg.SSAA
+		big := cfg
+		big.Width, big.Height, big.SSAA, big.rays, big.frames = cfg.Width*n, cfg.Height*n, 1, nil, nil
+		if cfg.CompositeOver != nil {
+			big.CompositeOver = upscaled{cfg.CompositeOver, n}
+		}
+		f, err := RenderContext(ctx, big)
+		if f == nil {
+			return nil, err
+		}
+		return downsample(f, n), err
+	}
+
+	f := cfg.frames.get(cfg.Width, cfg.Height)
+	cfg.histogram = &f.Stats.luminance
+	if cp := cfg.Checkpoint; cp != nil {
+		if err := cp.start(&cfg, f); err != nil {
+			return nil, err
+		}
+		cfg.checkpoint = cp
+	}
+	pixel := renderPixel
+	if cfg.AA == AAFull {
+		pixel = supersample // no ray through the center to refine, the samples give the depth as well
+	}
+	err := forEachPixel(ctx, &cfg, func(cfg *RenderConfig, i, j int) { // actual rendering loop
+		c, d := pixel(cfg, i, j)
+		f.Color[i+j*cfg.Width], f.Depth[i+j*cfg.Width] = c, d
+		cfg.histogram.add(c)
+	})
+	cfg.histogram = nil
+	if cp := cfg.checkpoint; cp != nil {
+		cfg.checkpoint = nil
+		if err != nil { // keep what was rendered before the interruption
+			err = errors.Join(err, cp.save())
+		}
+	}
+	if err != nil {
+		fill_background(&cfg, f)
+		return f, err
+	}
+
+	if cfg.AA == AAFull {
+		f.Stats.Refined = len(f.Color)
+	} else if cfg.AA != AANone {
+		var refine []bool
+		switch cfg.AA {
+		case AAAdaptive:
+			refine = high_contrast_pixels(f, cfg.AAThreshold)
+		case AADepth:
+			refine = depth_edge_pixels(f, cfg.AAThreshold)
+		default:
+			refine = silhouette_pixels(f)
+		}
+		err := forEachPixel(ctx, &cfg, func(cfg *RenderConfig, i, j int) {
+			if refine[i+j*cfg.Width] {
+				f.Color[i+j*cfg.Width], _ = supersample(cfg, i, j)
+			}
+		})
+		for _, r := range refine {
+			if r {
+				f.Stats.Refined++
+			}
+		}
+		if err != nil {
+			return f, err
+		}
+	}
+
+	if cfg.Scene.Sparks > 0 {
+		draw_sparks(&cfg, f)
+	}
+	return f, nil
+}
+
+// Validate reports the first problem found with the scene or the image parameters, RenderContext checks it first.
+func (cfg RenderConfig) Validate() error {
+	if err := cfg.Scene.Validate(); err != nil {
+		return err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return fmt.Errorf("invalid image size %dx%d, width and height must be positive", cfg.Width, cfg.Height)
+	}
+	if !(cfg.FOV > 0 && cfg.FOV < math.Pi) {
+		return fmt.Errorf("invalid field of view %g, it must be in (0,π)", cfg.FOV)
+	}
+	if !(cfg.Zoom >= 0) || math.IsInf(cfg.Zoom, 0) {
+		return fmt.Errorf("invalid zoom factor %g", cfg.Zoom)
+	}
+	if !(cfg.PixelAspect >= 0) || math.IsInf(cfg.PixelAspect, 0) {
+		return fmt.Errorf("invalid pixel aspect ratio %g", cfg.PixelAspect)
+	}
+	if cfg.Projection == ProjectionCylindrical && !(cfg.HFOV > 0 && cfg.HFOV <= 2*math.Pi) {
+		return fmt.Errorf("invalid horizontal field of view %g, it must be in (0,2π]", cfg.HFOV)
+	}
+	if cfg.Workers < 0 {
+		return fmt.Errorf("invalid number of workers %d", cfg.Workers)
+	}
+	if o := cfg.CompositeOver; o != nil {
+		if cfg.Backdrop != nil {
+			return errors.New("an image can't be composited over a backdrop, set one of them")
+		}
+		if b := o.Bounds(); b.Dx() != cfg.Width || b.Dy() != cfg.Height {
+			return fmt.Errorf("the image to composite over is %dx%d, the render %dx%d", b.Dx(), b.Dy(), cfg.Width, cfg.Height)
+		}
+	}
+	if cfg.Checkpoint != nil && (cfg.Stereo != StereoNone || cfg.MotionBlur > 1) {
+		return errors.New("a checkpoint can't record the several renders of a stereo or motion blurred image")
+	}
+	return nil
+}
+
+// fill_background sets the pixels of f that haven't been rendered to the background.
+func fill_background(cfg *RenderConfig, f *Frame) {
+	for j := 0; j < f.Height; j++ {
+		for i := 0; i < f.Width; i++ {
+			if f.Color[i+j*f.Width] == nil {
+				x, y := float64(i)+0.5, float64(screen_row(cfg, j))+0.5
+				_, dir := camera_ray(cfg, x, y)
+				f.Color[i+j*f.Width], f.Depth[i+j*f.Width] = background_color(cfg, x, y, dir), math.Inf(1)
+			}
+		}
+	}
+}
+
+// render_motion_blur averages cfg.MotionBlur renders taken at the middle of as many equal slices of the shutter interval.
+func render_motion_blur(ctx context.Context, cfg RenderConfig) (*Frame, error) {
+	n := cfg.MotionBlur
+	start := cfg.Scene.Time
+	cfg.MotionBlur = 1
+
+	var f *Frame
+	var err error
+	k := 0
+	for ; k < n && err == nil; k++ {
+		cfg.Scene.Time = start + (float64(k)+0.5)/float64(n)*cfg.Shutter
+		var sub *Frame
+		sub, err = RenderContext(ctx, cfg)
+		if sub == nil {
+			return nil, err
+		}
+		if f == nil {
+			f = sub
+			continue
+		}
+		for i, c := range sub.Color {
+			f.Color[i] = f.Color[i].Add(c)
+			f.Depth[i] = math.Min(f.Depth[i], sub.Depth[i])
+		}
+		f.Stats.merge(&sub.Stats)
+		cfg.frames.put(sub)
+	}
+	for i, c := range f.Color {
+		f.Color[i] = c.Mul(1 / float64(k))
+	}
+	return f, err
+}
+
+// RenderSequence renders frames consecutive frames of the animation starting at cfg.Scene.Time, advancing the
+// time by 1/cfg.FPS seconds per frame, and hands each framebuffer to onFrame. The sequence stops at the first
+// error returned by onFrame, which is returned.
+func RenderSequence(cfg RenderConfig, frames int, onFrame func(i int, fb []*Vec) error) error {
+	return render_sequence(context.Background(), cfg, 0, frames, func(i int, f *Frame) error {
+		return onFrame(i, f.Color)
+	})
+}
+
+// render_sequence renders the frames [first,end) of the animation until ctx is done, the time of each frame
+// following from its number alone so a sequence can be rendered in several parts. The partial frame being
+// rendered when ctx is done is still handed to onFrame before the error of ctx is returned.
+func render_sequence(ctx context.Context, cfg RenderConfig, first, end int, onFrame func(i int, f *Frame) error) error {
+	base := cfg
+	if cfg.Width > 0 && cfg.Height > 0 {
+		cfg.rays = new_ray_grid(&cfg) // the camera doesn't move, only the time does
+	}
+	for i := first; i < end; i++ {
+		cfg.Scene.Time = FrameTime(&base, i)
+		f, err := RenderContext(ctx, cfg)
+		if f == nil {
+			return err
 		}
+		if err := onFrame(i, f); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// WriteSequence renders the frames [first,end) of an animation, handing each one to write on one of encoders
+// goroutines so the next frame renders while the previous ones are encoded. The render waits when all the
+// encoders are busy, bounding the frames in memory, and the frames written out are recycled, so write mustn't
+// keep them. The first error stops the render once the frames in flight are written.
+func WriteSequence(ctx context.Context, cfg RenderConfig, first, end, encoders int, write func(f *Frame, n int) error) error {
+	type job struct {
+		frame *Frame
+		n     int
+	}
+	cfg.frames = new_frame_pool(encoders + 1)
+	jobs := make(chan job)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		writeErr error
+	)
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return writeErr
+	}
+	for range encoders {
 		wg.Add(1)
-		go (func(min, max int) {
-			for j := min; j < max; j++ { // actual rendering loop
-				for i := 0; i < width; i++ {
-					dir_x := (float64(i) + 0.5) - width/2.0
-					dir_y := -(float64(j) + 0.5) + height/2.0 // this flips the image at the same time
-					dir_z := -height / (2.0 * math.Tan(fov/2.0))
-					var hit Vec
-					if sphere_trace(NewVec(0, 0, 3), NewVec(dir_x, dir_y, dir_z).Normalize(1), &hit) { // the camera is placed to (0,0,3) and it looks along the -z axis
-						noise_level := (sphere_radius - hit.Norm()) / noise_amplitude
-						light_dir := (NewVec(10, 10, 10).Sub(&hit)).Normalize(1) // one light is placed to (10,10,10)
-						light_intensity := math.Max(0.4, light_dir.Dot(distance_field_normal(&hit)))
-						framebuffer[i+j*width] = palette_fire((-.2 + noise_level) * 2).Mul(light_intensity)
-					} else {
-						framebuffer[i+j*width] = NewVec(0.2, 0.7, 0.8) // background color
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := write(j.frame, j.n); err != nil {
+					mu.Lock()
+					if writeErr == nil {
+						writeErr = err
+					}
+					mu.Unlock()
+				}
+				cfg.frames.put(j.frame)
+			}
+		}()
+	}
+	err := render_sequence(ctx, cfg, first, end, func(i int, frame *Frame) error {
+		if err := failed(); err != nil {
+			return err
+		}
+		jobs <- job{frame, i}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	if werr := failed(); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// FrameTime is the scene time of the frame number i of the animation of cfg, starting at cfg.Scene.Time.
+func FrameTime(cfg *RenderConfig, i int) float64 {
+	fps := cfg.FPS
+	if fps <= 0 {
+		fps = 24
+	}
+	return cfg.Scene.Time + float64(i)/fps
+}
+
+// NumWorkers returns the number of worker goroutines of forEachPixel and reduceTiles.
+func NumWorkers(cfg *RenderConfig) int {
+	if cfg.Workers > 0 {
+		return cfg.Workers
+	}
+	return runtime.NumCPU()
+}
+
+// forEachPixel calls fn for every pixel of the image. The image is split into tiles handed out to cfg.Workers
+// worker goroutines, so fn must be safe to call concurrently for different pixels. Each worker passes fn its
+// own copy of cfg, holding the worker's noise cache and luminance histogram. The tiles cfg.checkpoint has are
+// skipped, and the others are recorded in it as they are completed. The workers stop at the end of the current
+// row when ctx is done, forEachPixel then returns the error of ctx.
+func forEachPixel(ctx context.Context, cfg *RenderConfig, fn func(cfg *RenderConfig, i, j int)) error {
+	size := cfg.TileSize
+	if size <= 0 {
+		size = cfg.Width
+	}
+	all := splitTiles(cfg.Width, cfg.Height, size)
+	cfg.Progress.start(cfg.Width * cfg.Height)
+	tiles := make(chan int) // numbers of the tiles in all
+	var wg sync.WaitGroup
+	workers := make([]RenderConfig, NumWorkers(cfg))
+	for n := range workers {
+		wg.Add(1)
+		worker := &workers[n]
+		*worker = *cfg
+		if cfg.NoiseCache {
+			worker.Scene.noise = &noiseCache{}
+		}
+		if cfg.VecPool {
+			worker.Scene.vecs = &vecArena{}
+		}
+		if cfg.histogram != nil {
+			worker.histogram = &histogram{}
+		}
+		go (func() {
+			for k := range tiles {
+				t := all[k]
+				for j := t.y0; j < t.y1 && ctx.Err() == nil; j++ {
+					for i := t.x0; i < t.x1; i++ {
+						fn(worker, i, j)
+						worker.Scene.vecs.release() // for the rays not shaded by shade_ray, like the samples of CheapAA
 					}
+					cfg.Progress.add(t.x1 - t.x0)
+				}
+				if ctx.Err() == nil {
+					cfg.checkpoint.tile_done(k)
 				}
 			}
 			wg.Done()
-		})(min, max)
+		})()
+	}
+	for k := range all {
+		if ctx.Err() != nil {
+			break
+		}
+		if !cfg.checkpoint.is_done(k) {
+			tiles <- k
+		} else {
+			cfg.Progress.add((all[k].x1 - all[k].x0) * (all[k].y1 - all[k].y0))
+		}
 	}
+	close(tiles)
 	wg.Wait()
+	if cfg.histogram != nil {
+		for n := range workers { // merged in a fixed order once the workers are done, they never share one
+			cfg.histogram.merge(workers[n].histogram)
+		}
+	}
+	return ctx.Err()
+}
 
-	b := &bytes.Buffer{}
+// WritePPM encodes the first width x height colors of the framebuffer to w as a binary PPM with 8 bits per
+// channel, clamped to [0,1].
+func WritePPM(w io.Writer, framebuffer []*Vec, width, height int) error {
+	b := bufio.NewWriter(w)
 	fmt.Fprintf(b, "P6\n%d %d\n255\n", width, height)
 	for i := 0; i < height*width; i++ {
 		b.WriteByte(byte(math.Max(0, math.Min(255, 255*framebuffer[i].x))))
 		b.WriteByte(byte(math.Max(0, math.Min(255, 255*framebuffer[i].y))))
 		b.WriteByte(byte(math.Max(0, math.Min(255, 255*framebuffer[i].z))))
 	}
+	return b.Flush()
+}
 
-	if f, err := os.Create("./out-go.ppm"); err != nil {
-		log.Print(err)
-		return
-	} else {
-		defer f.Close()
-		if _, err := f.Write(b.Bytes()); err != nil {
-			log.Print(err)
+// WritePPM16 is WritePPM with 16 bits per channel, big-endian as the format wants.
+func WritePPM16(w io.Writer, framebuffer []*Vec, width, height int) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "P6\n%d %d\n65535\n", width, height)
+	for i := 0; i < height*width; i++ {
+		for _, v := range [3]float64{framebuffer[i].x, framebuffer[i].y, framebuffer[i].z} {
+			q := uint16(math.Max(0, math.Min(65535, 65535*v)))
+			b.WriteByte(byte(q >> 8))
+			b.WriteByte(byte(q))
+		}
+	}
+	return b.Flush()
+}
+
+// WriteDepthPGM encodes the depth of the frame to w as an 8-bit binary PGM, scaled over the range of the
+// depths of the frame: the nearest hits are white, the farthest 1 and the missed rays 0, black, so they can be
+// told apart from the surface.
+func WriteDepthPGM(w io.Writer, f *Frame) error {
+	near, far := math.Inf(1), math.Inf(-1)
+	for _, d := range f.Depth {
+		if !math.IsInf(d, 1) {
+			near, far = math.Min(near, d), math.Max(far, d)
+		}
+	}
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "P5\n%d %d\n255\n", f.Width, f.Height)
+	for _, d := range f.Depth[:f.Width*f.Height] {
+		switch {
+		case math.IsInf(d, 1):
+			b.WriteByte(0)
+		case far == near:
+			b.WriteByte(255)
+		default:
+			b.WriteByte(byte(math.Round(255 - 254*(d-near)/(far-near))))
+		}
+	}
+	return b.Flush()
+}
+
+// BandsAt8Bits reports whether enough of the frame is a gradient too smooth for 8 bits per channel, which
+// truncates it into flat bands with a visible step between them. The frame is split into 8x8 blocks, a block is
+// smooth when its pixels differ from their neighbors by less than an 8-bit level but still change across it:
+// the noisy flames have steeper gradients in every block and the flat background doesn't change at all.
+func BandsAt8Bits(f *Frame) bool {
+	const (
+		block    = 8
+		fraction = 0.05 // of the blocks being smooth for the frame to band
+	)
+	clamp := func(x float64) float64 { return math.Max(0, math.Min(1, x)) }
+	step := func(a, b *Vec) float64 {
+		return math.Max(math.Abs(clamp(a.x)-clamp(b.x)), math.Max(math.Abs(clamp(a.y)-clamp(b.y)), math.Abs(clamp(a.z)-clamp(b.z))))
+	}
+	smooth, blocks := 0, 0
+	for y := 0; y+block <= f.Height; y += block {
+		for x := 0; x+block <= f.Width; x += block {
+			steepest, changes := 0.0, false
+			for j := y; j < y+block; j++ {
+				for i := x; i < x+block; i++ {
+					c := f.Color[i+j*f.Width]
+					if i+1 < x+block {
+						steepest = math.Max(steepest, step(c, f.Color[i+1+j*f.Width]))
+					}
+					if j+1 < y+block {
+						steepest = math.Max(steepest, step(c, f.Color[i+(j+1)*f.Width]))
+					}
+					changes = changes || step(c, f.Color[x+y*f.Width]) > 0
+				}
+			}
+			if changes && steepest < 1.0/255 {
+				smooth++
+			}
+			blocks++
 		}
 	}
+	return float64(smooth) > fraction*float64(blocks)
 }
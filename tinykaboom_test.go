@@ -0,0 +1,730 @@
+package tinykaboom
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAngleTo(t *testing.T) {
+	tests := []struct {
+		v, o *Vec
+		want float64
+	}{
+		{NewVec(1, 0, 0), NewVec(0, 1, 0), math.Pi / 2},
+		{NewVec(0, 0, 2), NewVec(0, 3, 0), math.Pi / 2},
+		{NewVec(1, 1, 0), NewVec(1, 0, 0), math.Pi / 4},
+		{NewVec(1, 2, 3), NewVec(2, 4, 6), 0},
+		{NewVec(1, 2, 3), NewVec(-1, -2, -3), math.Pi},
+		{NewVec(0, 0, 0), NewVec(1, 0, 0), 0},
+		{NewVec(1, 0, 0), NewVec(0, 0, 0), 0},
+	}
+	for _, tt := range tests {
+		if got := tt.v.AngleTo(tt.o); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("%v.AngleTo(%v) = %v, want %v", tt.v, tt.o, got, tt.want)
+		}
+	}
+}
+
+func TestRenderContextCancel(t *testing.T) {
+	cfg := RenderConfig{Width: 1000, Height: 1000, FOV: math.Pi / 3, Scene: NewScene(), Workers: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	f, err := RenderContext(ctx, cfg)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("RenderContext returned %v after the start, canceled at 50ms", elapsed)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("RenderContext returned the error %v, want context.Canceled", err)
+	}
+	if f == nil {
+		t.Fatal("RenderContext returned no partial frame")
+	}
+	for k, c := range f.Color {
+		if c == nil {
+			t.Fatalf("pixel %d of the partial frame is nil", k)
+		}
+	}
+}
+
+func TestSphereTrace(t *testing.T) {
+	s := NewScene()
+	tests := []struct {
+		name      string
+		orig, dir *Vec
+		hit       bool
+		steps     int // only checked for the early discarded rays, -1 otherwise
+	}{
+		{"towards the center", NewVec(0, 0, 3), NewVec(0, 0, -1), true, -1},
+		{"away from it", NewVec(0, 0, 3), NewVec(0, 0, 1), false, -1},
+		{"tangent far outside", NewVec(0, 10, 3), NewVec(0, 0, -1), false, 0},
+		{"outside the bounding sphere", NewVec(5, 5, 5), NewVec(1, 0, 0), false, 0},
+	}
+	for _, tt := range tests {
+		var pos Vec
+		hit, _, steps := sphere_trace_steps(tt.orig, tt.dir, &pos, &s)
+		if hit != tt.hit {
+			t.Errorf("%s: sphere_trace_steps hit %t, want %t", tt.name, hit, tt.hit)
+		}
+		if tt.steps >= 0 && steps != tt.steps {
+			t.Errorf("%s: %d steps, want %d", tt.name, steps, tt.steps)
+		}
+		var p Vec
+		if got := sphere_trace(tt.orig, tt.dir, &p, &s); got != tt.hit {
+			t.Errorf("%s: sphere_trace hit %t, want %t", tt.name, got, tt.hit)
+		}
+		if !tt.hit {
+			continue
+		}
+		if p.Sub(&pos).Norm() > 1e-9 { // orig+t*dir and the sum of the steps, within rounding
+			t.Errorf("%s: sphere_trace hit %v, sphere_trace_steps %v", tt.name, &p, &pos)
+		}
+		if d := signed_distance(&p, &s); d > 0 || d < -0.05 {
+			t.Errorf("%s: the hit %v is at the signed distance %g of the surface, want in [-0.05,0]", tt.name, &p, d)
+		}
+	}
+}
+
+func TestRenderInvalidSize(t *testing.T) {
+	for _, size := range [][2]int{{0, 48}, {64, 0}, {-1, 48}} {
+		cfg := RenderConfig{Width: size[0], Height: size[1], FOV: math.Pi / 3, Scene: NewScene()}
+		if fb, err := Render(cfg); err == nil || fb != nil {
+			t.Errorf("Render of a %dx%d image returned %d pixels and the error %v, want an error", size[0], size[1], len(fb), err)
+		}
+	}
+}
+
+func TestLuminance(t *testing.T) {
+	tests := []struct {
+		c    *Vec
+		want float64
+	}{
+		{NewVec(0, 0, 0), 0},
+		{NewVec(1, 1, 1), 1},
+		{NewVec(1, 0, 0), 0.2126},
+		{NewVec(0, 1, 0), 0.7152},
+		{NewVec(0, 0, 1), 0.0722},
+		{NewVec(2, 2, 2), 2},
+	}
+	for _, tt := range tests {
+		if got := tt.c.Luminance(); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("%v.Luminance() = %g, want %g", tt.c, got, tt.want)
+		}
+	}
+}
+
+func TestAbsMinMax(t *testing.T) {
+	tests := []struct {
+		v, o, abs, min, max *Vec
+	}{
+		{NewVec(1, 2, 3), NewVec(3, 2, 1), NewVec(1, 2, 3), NewVec(1, 2, 1), NewVec(3, 2, 3)},
+		{NewVec(-1, -2, -3), NewVec(-3, -2, -1), NewVec(1, 2, 3), NewVec(-3, -2, -3), NewVec(-1, -2, -1)},
+		{NewVec(-1, 2, -3), NewVec(1, -2, 0), NewVec(1, 2, 3), NewVec(-1, -2, -3), NewVec(1, 2, 0)},
+		{NewVec(0, -0.5, 4), NewVec(0, 0.5, -4), NewVec(0, 0.5, 4), NewVec(0, -0.5, -4), NewVec(0, 0.5, 4)},
+	}
+	for _, tt := range tests {
+		if got := tt.v.Abs(); *got != *tt.abs {
+			t.Errorf("%v.Abs() = %v, want %v", tt.v, got, tt.abs)
+		}
+		if got := tt.v.Min(tt.o); *got != *tt.min {
+			t.Errorf("%v.Min(%v) = %v, want %v", tt.v, tt.o, got, tt.min)
+		}
+		if got := tt.v.Max(tt.o); *got != *tt.max {
+			t.Errorf("%v.Max(%v) = %v, want %v", tt.v, tt.o, got, tt.max)
+		}
+	}
+}
+
+// failingWriter accepts n bytes, then fails every write.
+type failingWriter struct {
+	n int
+}
+
+var errWriterFull = errors.New("writer full")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errWriterFull
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestWriteError(t *testing.T) {
+	f := new_frame(64, 48)
+	for k := range f.Color {
+		f.Color[k], f.Depth[k] = NewVec(0.5, 0.5, 0.5), 1
+	}
+	writers := map[string]func(w *failingWriter) error{
+		"WritePPM":      func(w *failingWriter) error { return WritePPM(w, f.Color, f.Width, f.Height) },
+		"WritePPM16":    func(w *failingWriter) error { return WritePPM16(w, f.Color, f.Width, f.Height) },
+		"WriteDepthPGM": func(w *failingWriter) error { return WriteDepthPGM(w, f) },
+	}
+	for name, write := range writers {
+		for _, n := range []int{0, 10, 3000} { // at the start, in the header, in the pixels
+			if err := write(&failingWriter{n}); !errors.Is(err, errWriterFull) {
+				t.Errorf("%s to a writer failing after %d bytes returned %v, want %v", name, n, err, errWriterFull)
+			}
+		}
+		if err := write(&failingWriter{1 << 20}); err != nil {
+			t.Errorf("%s returned %v with room for the whole image", name, err)
+		}
+	}
+}
+
+func TestWith(t *testing.T) {
+	v := NewVec(1, 2, 3)
+	tests := []struct {
+		got, want *Vec
+	}{
+		{v.WithX(-4), NewVec(-4, 2, 3)},
+		{v.WithY(-4), NewVec(1, -4, 3)},
+		{v.WithZ(-4), NewVec(1, 2, -4)},
+		{v.WithX(0).WithZ(5), NewVec(0, 2, 5)},
+	}
+	for _, tt := range tests {
+		if *tt.got != *tt.want {
+			t.Errorf("got %v, want %v", tt.got, tt.want)
+		}
+	}
+	if *v != *NewVec(1, 2, 3) {
+		t.Errorf("the With methods changed their receiver into %v", v)
+	}
+}
+
+func TestNoDiscard(t *testing.T) {
+	// the bounding sphere is a conservative bound of the fireball, marching the rays outside it changes nothing
+	cfg := RenderConfig{Width: 48, Height: 36, FOV: math.Pi / 3, Scene: NewScene()}
+	want, err := Render(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Scene.NoDiscard = true
+	got, err := Render(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range want {
+		if *got[k] != *want[k] {
+			t.Fatalf("pixel %d is %v with NoDiscard, %v without", k, got[k], want[k])
+		}
+	}
+
+	// a shape larger than the bounding sphere is only hit outside it with NoDiscard
+	s := NewScene()
+	s.SDF = func(p *Vec) float64 { return p.Norm() - 2.5 }
+	orig, dir := NewVec(0, 0, 5), NewVec(0, 2.2, -5).Normalize(1) // passing 2.2 from the center
+	var pos Vec
+	if sphere_trace(orig, dir, &pos, &s) {
+		t.Errorf("the ray passing 2.2 from the center hit %v inside the bounding sphere of radius %g", &pos, SceneRadius(&s))
+	}
+	s.NoDiscard = true
+	if !sphere_trace(orig, dir, &pos, &s) {
+		t.Error("the ray passing 2.2 from the center missed the shape of radius 2.5 with NoDiscard")
+	}
+}
+
+func TestRefract(t *testing.T) {
+	n := NewVec(0, 1, 0)
+	s45 := math.Sqrt(0.5)
+	sin := s45 / 1.5 // Snell's law from the air into the glass at 45°
+	tests := []struct {
+		name string
+		v    *Vec
+		eta  float64
+		want *Vec // nil for a total internal reflection
+	}{
+		{"normal incidence", NewVec(0, -1, 0), 1 / 1.5, NewVec(0, -1, 0)},
+		{"into the glass at 45°", NewVec(s45, -s45, 0), 1 / 1.5, NewVec(sin, -math.Sqrt(1-sin*sin), 0)},
+		{"out of the glass from the back", NewVec(sin, math.Sqrt(1-sin*sin), 0), 1 / 1.5, NewVec(s45, s45, 0)},
+		{"total internal reflection at 45°", NewVec(s45, -s45, 0), 1.5, nil},
+		{"grazing total internal reflection", NewVec(0.99, -math.Sqrt(1-0.99*0.99), 0), 1.2, nil},
+	}
+	for _, tt := range tests {
+		got, ok := tt.v.Refract(n, tt.eta)
+		switch {
+		case tt.want == nil && ok:
+			t.Errorf("%s: Refract returned %v, want a total internal reflection", tt.name, got)
+		case tt.want != nil && !ok:
+			t.Errorf("%s: Refract reported a total internal reflection, want %v", tt.name, tt.want)
+		case ok && got.Sub(tt.want).Norm() > 1e-12:
+			t.Errorf("%s: Refract returned %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInsideSurface(t *testing.T) {
+	s := NewScene()
+	tests := []struct {
+		p    *Vec
+		want bool
+	}{
+		{NewVec(0, 0, 0), true},
+		{NewVec(0, 0, 3), false},
+		{NewVec(10, -10, 10), false},
+		{NewVec(0, SceneRadius(&s), 0), false}, // the noise only carves inwards
+	}
+	for _, tt := range tests {
+		if got := InsideSurface(tt.p, &s); got != tt.want {
+			t.Errorf("InsideSurface(%v) = %t, want %t", tt.p, got, tt.want)
+		}
+	}
+	s.Center = NewVec(5, 0, 0)
+	if !InsideSurface(s.Center, &s) || InsideSurface(NewVec(0, 0, 0), &s) {
+		t.Errorf("InsideSurface doesn't follow the explosion moved to %v", s.Center)
+	}
+}
+
+func TestRoll(t *testing.T) {
+	// spread returns the ranges of the x and y components of the ray directions over the image
+	spread := func(cfg *RenderConfig) (dx, dy float64) {
+		minx, maxx, miny, maxy := math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)
+		for j := 0; j < cfg.Height; j++ {
+			for i := 0; i < cfg.Width; i++ {
+				_, dir := camera_ray(cfg, float64(i)+0.5, float64(j)+0.5)
+				minx, maxx, miny, maxy = math.Min(minx, dir.x), math.Max(maxx, dir.x), math.Min(miny, dir.y), math.Max(maxy, dir.y)
+			}
+		}
+		return maxx - minx, maxy - miny
+	}
+	cfg := RenderConfig{Width: 64, Height: 48, FOV: math.Pi / 3, Scene: NewScene()}
+	wx, wy := spread(&cfg)
+	if !(wx > wy) {
+		t.Fatalf("the rays of the landscape image spread %g horizontally, %g vertically", wx, wy)
+	}
+	cfg.Scene.Roll = math.Pi / 2
+	rx, ry := spread(&cfg)
+	if math.Abs(rx-wy) > 1e-12 || math.Abs(ry-wx) > 1e-12 {
+		t.Errorf("rolled 90°, the rays spread %g horizontally and %g vertically, want %g and %g", rx, ry, wy, wx)
+	}
+	if r := camera_right(&cfg.Scene); r.Sub(NewVec(0, 1, 0)).Norm() > 1e-12 {
+		t.Errorf("rolled 90° counterclockwise, the right of the image points to %v, want up", r)
+	}
+}
+
+// TestAwkwardSplits renders images whose height divides neither by the workers nor by the tiles, and checks
+// every pixel is rendered the same as by a single worker.
+func TestAwkwardSplits(t *testing.T) {
+	cfg := RenderConfig{Width: 23, Height: 37, FOV: math.Pi / 3, Scene: NewScene(), Workers: 1}
+	want, err := Render(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, split := range [][2]int{{3, 0}, {5, 0}, {7, 10}, {36, 0}, {37, 0}, {64, 4}, {2, 23}, {4, 100}} {
+		cfg.Workers, cfg.TileSize = split[0], split[1]
+		got, err := Render(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := range want {
+			if got[k] == nil {
+				t.Fatalf("%d workers and tiles of %d: pixel %d (row %d) isn't rendered", cfg.Workers, cfg.TileSize, k, k/cfg.Width)
+			}
+			if *got[k] != *want[k] {
+				t.Fatalf("%d workers and tiles of %d: pixel %d is %v, %v with 1 worker", cfg.Workers, cfg.TileSize, k, got[k], want[k])
+			}
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		v    *Vec
+		l    float64
+		want *Vec
+	}{
+		{NewVec(3, 0, 4), 1, NewVec(0.6, 0, 0.8)},
+		{NewVec(3, 0, 4), 10, NewVec(6, 0, 8)},
+		{NewVec(0, -2, 0), 1, NewVec(0, -1, 0)},
+	}
+	for _, tt := range tests {
+		was := *tt.v
+		got := tt.v.Normalize(tt.l)
+		if got.Sub(tt.want).Norm() > 1e-12 {
+			t.Errorf("%v.Normalize(%g) = %v, want %v", &was, tt.l, got, tt.want)
+		}
+		if *tt.v != was || got == tt.v {
+			t.Errorf("%v.Normalize(%g) changed its receiver into %v", &was, tt.l, tt.v)
+		}
+	}
+}
+
+// TestOffAxisDiscard checks the early discard stays conservative for origins off the z axis: the rays it
+// discards miss the surface when marched, and an off-axis camera renders the same without it.
+func TestOffAxisDiscard(t *testing.T) {
+	s := NewScene()
+	origins := []*Vec{NewVec(2, 1, 4), NewVec(-3, 2, -1), NewVec(0, -4, 0.5), NewVec(5, 5, 5)}
+	discarded := 0
+	for _, orig := range origins {
+		for k := 0; k < 200; k++ {
+			// directions spread around the one towards the center, some missing the bounding sphere
+			h := uint64(k) * 0x9e3779b97f4a7c15
+			to := NewVec(4*unit_hash(h)-2, 4*unit_hash(h^1)-2, 4*unit_hash(h^2)-2)
+			dir := to.Sub(orig).Normalize(1)
+			var pos Vec
+			if _, _, steps := sphere_trace_steps(orig, dir, &pos, &s); steps != 0 {
+				continue
+			}
+			discarded++
+			marched := s
+			marched.NoDiscard = true
+			if sphere_trace(orig, dir, &pos, &marched) {
+				t.Errorf("the ray from %v of direction %v was discarded but hits %v", orig, dir, &pos)
+			}
+		}
+	}
+	if discarded == 0 {
+		t.Fatal("no ray was discarded")
+	}
+
+	cfg := RenderConfig{Width: 48, Height: 36, FOV: math.Pi / 3, Scene: NewScene()}
+	cfg.Scene.Camera = NewVec(1, 0.5, 3)
+	want, err := RenderFrame(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Scene.NoDiscard = true
+	got, err := RenderFrame(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits := 0
+	for k := range want.Color {
+		if *got.Color[k] != *want.Color[k] {
+			t.Fatalf("pixel %d of the off-axis camera is %v with NoDiscard, %v without", k, got.Color[k], want.Color[k])
+		}
+		if !math.IsInf(want.Depth[k], 1) {
+			hits++
+		}
+	}
+	if hits == 0 || hits == len(want.Depth) {
+		t.Errorf("the off-axis camera sees the explosion in %d of the %d pixels", hits, len(want.Depth))
+	}
+}
+
+func TestLights(t *testing.T) {
+	cfg := RenderConfig{Width: 48, Height: 36, FOV: math.Pi / 3, Scene: NewScene()}
+	cfg.Scene.Lights = []*Vec{NewVec(10, 0, 0)}
+	left, leftNormal := NewVec(-1.5, 0, 0), NewVec(-1, 0, 0)
+	if got := illumination(&cfg, left, leftNormal); got != cfg.Scene.Ambient {
+		t.Errorf("the side facing away from the light gets %g, want the ambient %g", got, cfg.Scene.Ambient)
+	}
+	one, err := RenderFrame(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Scene.Lights = append(cfg.Scene.Lights, NewVec(-10, 0, 0))
+	if got := illumination(&cfg, left, leftNormal); math.Abs(got-1) > 1e-12 {
+		t.Errorf("the side facing the second light gets %g, want 1", got)
+	}
+	top := NewVec(0, 1.5, 0)
+	cfg.Scene.Lights = []*Vec{NewVec(10, 11.5, 0), NewVec(-10, 11.5, 0)} // both at 45° above the top
+	if got := illumination(&cfg, top, NewVec(0, 1, 0)); math.Abs(got-math.Sqrt2) > 1e-12 {
+		t.Errorf("the top lit by two lights at 45° gets %g, want their sum %g", got, math.Sqrt2)
+	}
+
+	cfg.Scene.Lights = []*Vec{NewVec(10, 0, 0), NewVec(-10, 0, 0)}
+	two, err := RenderFrame(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	luminance := func(f *Frame) (sum float64) { // of the left half, away from the first light
+		for j := 0; j < f.Height; j++ {
+			for i := 0; i < f.Width/2; i++ {
+				sum += f.Color[i+j*f.Width].Luminance()
+			}
+		}
+		return sum
+	}
+	if l1, l2 := luminance(one), luminance(two); !(l2 > l1) {
+		t.Errorf("the left half has the luminance %g with the opposing light, %g without", l2, l1)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	render := func(seed float64) []*Vec {
+		cfg := RenderConfig{Width: 48, Height: 36, FOV: math.Pi / 3, Scene: NewScene()}
+		cfg.Scene.Seed = seed
+		fb, err := Render(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fb
+	}
+	differ := func(a, b []*Vec) int {
+		n := 0
+		for k := range a {
+			if *a[k] != *b[k] {
+				n++
+			}
+		}
+		return n
+	}
+	for _, seed := range []float64{0, 7} {
+		if n := differ(render(seed), render(seed)); n != 0 {
+			t.Errorf("two renders of the seed %g differ in %d pixels", seed, n)
+		}
+	}
+	a, b := render(0), render(7)
+	if n := differ(a, b); n < len(a)/10 {
+		t.Errorf("the seeds 0 and 7 only differ in %d of the %d pixels", n, len(a))
+	}
+}
+
+func BenchmarkRender(b *testing.B) {
+	cfg := RenderConfig{Width: 160, Height: 120, FOV: math.Pi / 3, Scene: NewScene()}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Render(cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSphereTrace(b *testing.B) {
+	s := NewScene()
+	orig, dir := NewVec(0, 0, 3), NewVec(0.1, 0.2, -1).Normalize(1)
+	var pos Vec
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sphere_trace(orig, dir, &pos, &s)
+	}
+}
+
+func BenchmarkFractalBrownianMotion(b *testing.B) {
+	s := NewScene()
+	p := NewVec(1.1, 2.3, -0.7)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		fractal_brownian_motion(p, &s)
+	}
+}
+
+// BenchmarkTiles renders a 2000x2000 image in 32x32 tiles and in bands of whole rows. The camera is far enough
+// for the explosion to only fill the middle of the image, the rows through it taking most of the time.
+func BenchmarkTiles(b *testing.B) {
+	for _, size := range []int{32, 2000} {
+		name := "tiles"
+		if size == 2000 {
+			name = "bands"
+		}
+		b.Run(name, func(b *testing.B) {
+			cfg := RenderConfig{Width: 2000, Height: 2000, FOV: math.Pi / 3, Scene: NewScene(), TileSize: size}
+			cfg.Scene.Camera = NewVec(0, 0, 20)
+			for i := 0; i < b.N; i++ {
+				if _, err := Render(cfg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// march_add_mul is the march of sphere_trace_steps stepping with pos.Add(dir.Mul(step)), as before MulAdd.
+func march_add_mul(orig, dir, pos *Vec, s *Scene) (bool, float64, int) {
+	oc := orig.Sub(s.Center)
+	if !s.NoDiscard && oc.Dot(oc)-math.Pow(oc.Dot(dir), 2) > math.Pow(SceneRadius(s), 2) {
+		return false, 0, 0
+	}
+	*pos = *orig
+	t := 0.0
+	for i := 0; i < max_march_steps; i++ {
+		d := signed_distance(pos, s)
+		if d < 0 {
+			return true, t, i + 1
+		}
+		step := math.Max(d*0.1, .01)
+		*pos = *(pos.Add(dir.Mul(step)))
+		t += step
+	}
+	return false, t, max_march_steps
+}
+
+// BenchmarkMarch marches a ray hitting the explosion and one grazing it with the MulAdd step of
+// sphere_trace_steps and with the Add(Mul) one it replaced, reporting the allocations of the march loop.
+func BenchmarkMarch(b *testing.B) {
+	s := NewScene()
+	orig := NewVec(0, 0, 3)
+	dirs := []*Vec{NewVec(0.1, 0.2, -1).Normalize(1), NewVec(0.45, 0, -1).Normalize(1)}
+	for _, m := range []struct {
+		name  string
+		march func(orig, dir, pos *Vec, s *Scene) (bool, float64, int)
+	}{{"MulAdd", sphere_trace_steps}, {"Add(Mul)", march_add_mul}} {
+		b.Run(m.name, func(b *testing.B) {
+			var pos Vec
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m.march(orig, dirs[i%2], &pos, &s)
+			}
+		})
+	}
+}
+
+// BenchmarkNoiseCache computes the normals at points along a ray hitting the explosion, the finite differences
+// of distance_field_normal looking up the same noise cells, without and with the cache.
+func BenchmarkNoiseCache(b *testing.B) {
+	for _, cached := range []bool{false, true} {
+		name := "off"
+		if cached {
+			name = "on"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := NewScene()
+			if cached {
+				s.noise = &noiseCache{}
+			}
+			orig, dir := NewVec(0, 0, 3), NewVec(0.1, 0.2, -1).Normalize(1)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				distance_field_normal(orig.MulAdd(dir, 1.5+0.01*float64(i%32)), &s)
+			}
+		})
+	}
+}
+
+// BenchmarkSequence renders 10 frames of an animation with RenderSequence, which traces the camera rays once
+// for all of them, and with a Render per frame.
+func BenchmarkSequence(b *testing.B) {
+	const frames = 10
+	cfg := RenderConfig{Width: 64, Height: 48, FOV: math.Pi / 3, Scene: NewScene()}
+	b.Run("RenderSequence", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := RenderSequence(cfg, frames, func(int, []*Vec) error { return nil }); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Render", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for n := 0; n < frames; n++ {
+				frame := cfg
+				frame.Scene.Time = FrameTime(&cfg, n)
+				if _, err := Render(frame); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestSceneValidate(t *testing.T) {
+	if err := NewScene().Validate(); err != nil {
+		t.Fatalf("NewScene() is invalid: %v", err)
+	}
+	nan, inf := math.NaN(), math.Inf(1)
+	fog := func() *Fog { return &Fog{Density: 0.1, Height: -1, Falloff: 1, Color: NewVec(0.8, 0.8, 0.8)} }
+	floor := func() *Floor { return &Floor{Height: -1.5, Colors: [2]*Vec{NewVec(0, 0, 0), NewVec(1, 1, 1)}, Tile: 1} }
+	spot := func() SpotLight {
+		return SpotLight{Position: NewVec(0, 5, 0), Direction: NewVec(0, -1, 0), Angle: 0.5, Falloff: 0.1}
+	}
+	valid := NewScene()
+	valid.Fog, valid.Floor, valid.SpotLights = fog(), floor(), []SpotLight{spot()}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("the scene with fog, a floor and a spotlight is invalid: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		spoil func(s *Scene)
+	}{
+		{"nil center", func(s *Scene) { s.Center = nil }},
+		{"nil camera", func(s *Scene) { s.Camera = nil }},
+		{"NaN camera", func(s *Scene) { s.Camera = NewVec(0, nan, 3) }},
+		{"nil light", func(s *Scene) { s.Lights = []*Vec{nil} }},
+		{"infinite light", func(s *Scene) { s.Lights = append(s.Lights, NewVec(inf, 0, 0)) }},
+		{"NaN roll", func(s *Scene) { s.Roll = nan }},
+		{"NaN time", func(s *Scene) { s.Time = nan }},
+		{"NaN seed", func(s *Scene) { s.Seed = nan }},
+		{"infinite seed", func(s *Scene) { s.Seed = inf }},
+		{"negative palette bands", func(s *Scene) { s.PaletteBands = -1 }},
+		{"negative sparks", func(s *Scene) { s.Sparks = -1 }},
+		{"negative noise period", func(s *Scene) { s.NoisePeriod = -1 }},
+		{"negative radius", func(s *Scene) { s.Radius = -1 }},
+		{"4 noise dimensions", func(s *Scene) { s.NoiseDims = 4 }},
+		{"negative ambient", func(s *Scene) { s.Ambient = -0.1 }},
+		{"ambient above 1", func(s *Scene) { s.Ambient = 1.1 }},
+		{"NaN ambient", func(s *Scene) { s.Ambient = nan }},
+		{"negative fog density", func(s *Scene) { s.Fog = fog(); s.Fog.Density = -1 }},
+		{"NaN fog height", func(s *Scene) { s.Fog = fog(); s.Fog.Height = nan }},
+		{"zero fog falloff", func(s *Scene) { s.Fog = fog(); s.Fog.Falloff = 0 }},
+		{"nil fog color", func(s *Scene) { s.Fog = fog(); s.Fog.Color = nil }},
+		{"infinite floor height", func(s *Scene) { s.Floor = floor(); s.Floor.Height = inf }},
+		{"nil floor color", func(s *Scene) { s.Floor = floor(); s.Floor.Colors[1] = nil }},
+		{"zero floor tile", func(s *Scene) { s.Floor = floor(); s.Floor.Tile = 0 }},
+		{"nil spotlight position", func(s *Scene) { l := spot(); l.Position = nil; s.SpotLights = []SpotLight{l} }},
+		{"zero spotlight direction", func(s *Scene) { l := spot(); l.Direction = NewVec(0, 0, 0); s.SpotLights = []SpotLight{l} }},
+		{"spotlight angle of π", func(s *Scene) { l := spot(); l.Angle = math.Pi; s.SpotLights = []SpotLight{l} }},
+		{"spotlight falloff wider than the cone", func(s *Scene) { l := spot(); l.Falloff = 1; s.SpotLights = []SpotLight{l} }},
+	}
+	for _, tt := range tests {
+		s := NewScene()
+		tt.spoil(&s)
+		if err := s.Validate(); err == nil {
+			t.Errorf("%s: Validate returned nil, want an error", tt.name)
+		}
+	}
+}
+
+func TestNegate(t *testing.T) {
+	for _, v := range []*Vec{NewVec(0, 0, 0), NewVec(1, 2, 3), NewVec(-1, -2, -3), NewVec(-0.5, 4, -1e9)} {
+		if got, want := v.Negate(), v.Mul(-1); *got != *want {
+			t.Errorf("%v.Negate() = %v, want %v", v, got, want)
+		}
+	}
+}
+
+// TestCompositeOver renders the explosion over a black and a white image: their difference at every pixel is
+// the 1-α of the blend on all three channels, 0 or 1 but on the antialiased edges.
+func TestCompositeOver(t *testing.T) {
+	for _, ssaa := range []int{1, 2} {
+		cfg := RenderConfig{Width: 48, Height: 36, FOV: math.Pi / 3, Scene: NewScene(), AA: AAEdgeMask, AASamples: 3, SSAA: ssaa}
+		over := func(c color.Color) []*Vec {
+			img := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+			for k := 0; k < len(img.Pix); k += 4 {
+				r, g, b, a := c.RGBA()
+				img.Pix[k], img.Pix[k+1], img.Pix[k+2], img.Pix[k+3] = uint8(r>>8), uint8(g>>8), uint8(b>>8), uint8(a>>8)
+			}
+			cfg.CompositeOver = img
+			fb, err := Render(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return fb
+		}
+		black, white := over(color.Black), over(color.White)
+		edges := 0
+		for k := range black {
+			d := white[k].Sub(black[k])
+			if math.Abs(d.x-d.y) > 1e-9 || math.Abs(d.x-d.z) > 1e-9 || d.x < -1e-9 || d.x > 1+1e-9 {
+				t.Fatalf("SSAA %d: pixel %d is %v over white and %v over black, not a blend of the same alpha", ssaa, k, white[k], black[k])
+			}
+			if d.x > 1e-9 && d.x < 1-1e-9 {
+				edges++
+			}
+		}
+		if edges == 0 {
+			t.Errorf("SSAA %d: no pixel partly covered by the explosion", ssaa)
+		}
+	}
+
+	cfg := RenderConfig{Width: 48, Height: 36, FOV: math.Pi / 3, Scene: NewScene()}
+	cfg.CompositeOver = image.NewRGBA(image.Rect(0, 0, 40, 36))
+	if err := cfg.Validate(); err == nil {
+		t.Error("an image of another size than the render is accepted")
+	}
+	cfg.CompositeOver = image.NewRGBA(image.Rect(0, 0, 48, 36))
+	cfg.Backdrop = cfg.CompositeOver
+	if err := cfg.Validate(); err == nil {
+		t.Error("both an image to composite over and a backdrop are accepted")
+	}
+}
@@ -0,0 +1,45 @@
+package tinykaboom
+
+import "sync"
+
+// vec_pool holds the vectors of the finished rays for the next ones, so the long animations with RenderConfig.VecPool
+// on make less garbage for the collector to go through.
+var vec_pool = sync.Pool{New: func() any { return new(Vec) }}
+
+// vecArena hands out the temporary vectors of the ray being traced from vec_pool and puts them all back when the
+// ray is done: the points of noise and fractal_brownian_motion, the offset of the march and the points handed
+// to a custom SDF at every step of it. It isn't safe for concurrent use, forEachPixel gives each worker its own.
+type vecArena struct {
+	used []*Vec
+}
+
+// vec returns a vector set to v, of the pool until the next release, or a new one when a is nil. It is small
+// enough to be inlined, so without a pool the vector stays on the stack of the caller like a &Vec literal.
+func (a *vecArena) vec(v Vec) *Vec {
+	if a == nil {
+		return &v
+	}
+	return a.get(v)
+}
+
+// get is kept out of line, inlined in vec it would push vec over the inlining budget.
+//
+//go:noinline
+func (a *vecArena) get(v Vec) *Vec {
+	p := vec_pool.Get().(*Vec)
+	*p = v
+	a.used = append(a.used, p)
+	return p
+}
+
+// release puts the vectors handed out since the last release back in the pool, nothing when a is nil.
+func (a *vecArena) release() {
+	if a == nil {
+		return
+	}
+	for i, v := range a.used {
+		vec_pool.Put(v)
+		a.used[i] = nil
+	}
+	a.used = a.used[:0]
+}
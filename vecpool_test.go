@@ -0,0 +1,101 @@
+package tinykaboom
+
+import (
+	"math"
+	"runtime"
+	"testing"
+)
+
+func TestVecPool(t *testing.T) {
+	for _, scene := range []struct {
+		name string
+		set  func(s *Scene)
+	}{
+		{"fireball", func(s *Scene) {}},
+		{"torus", func(s *Scene) { s.SDF = SDFs["torus"] }},
+		{"periodic", func(s *Scene) { s.NoisePeriod = 4 }},
+		{"gradient", func(s *Scene) { s.GradientNoise, s.NoisePeriod = true, 4 }},
+	} {
+		cfg := RenderConfig{Width: 64, Height: 48, FOV: math.Pi / 3, Scene: NewScene(), Workers: 3, TileSize: 16}
+		scene.set(&cfg.Scene)
+		want, err := Render(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.VecPool = true
+		got, err := Render(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := range want {
+			if *got[k] != *want[k] {
+				t.Fatalf("%s: pixel %d is %v with the vector pool, %v without", scene.name, k, got[k], want[k])
+			}
+		}
+	}
+}
+
+// BenchmarkVecPool renders 100 frames of an animation of the torus, whose march hands a heap vector to the SDF
+// at every step, without and with RenderConfig.VecPool, and reports the time the garbage collector paused the
+// render for.
+func BenchmarkVecPool(b *testing.B) {
+	for _, pool := range []bool{false, true} {
+		name := "off"
+		if pool {
+			name = "on"
+		}
+		b.Run(name, func(b *testing.B) {
+			cfg := RenderConfig{Width: 32, Height: 24, FOV: math.Pi / 3, Scene: NewScene(), VecPool: pool}
+			cfg.Scene.SDF = SDFs["torus"]
+			b.ReportAllocs()
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := RenderSequence(cfg, 100, func(int, []*Vec) error { return nil }); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+			b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gcs/op")
+		})
+	}
+}
+
+// BenchmarkVecPoolMarch marches rays into the default fireball, the fireball SDF and the torus without and with a
+// vecArena, released after each ray like forEachPixel does, and reports the allocations of a march. The points a
+// custom SDF gets at every step, on the heap without the pool, come from it with the pool on; the default
+// fireball allocates nothing either way.
+func BenchmarkVecPoolMarch(b *testing.B) {
+	orig := NewVec(0, 0, 3)
+	dirs := []*Vec{NewVec(0.1, 0.2, -1).Normalize(1), NewVec(0.45, 0, -1).Normalize(1)}
+	for _, sdf := range []string{"", "fireball", "torus"} {
+		for _, pool := range []bool{false, true} {
+			name := sdf
+			if sdf == "" {
+				name = "default"
+			}
+			if pool {
+				name += "/on"
+			} else {
+				name += "/off"
+			}
+			b.Run(name, func(b *testing.B) {
+				s := NewScene()
+				s.SDF = SDFs[sdf]
+				if pool {
+					s.vecs = &vecArena{}
+				}
+				var pos Vec
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					sphere_trace_steps(orig, dirs[i%2], &pos, &s)
+					s.vecs.release()
+				}
+			})
+		}
+	}
+}